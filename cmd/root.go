@@ -4,8 +4,11 @@ import (
 	"context"
 	"flag"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"github.com/mediocregopher/radix/v4"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -92,9 +95,11 @@ func Run() {
 		b          broker.Broker
 		shardStore gateway.ShardStore
 		logLevel   = logLevels[*logLevel]
-		ctx        = context.Background()
 	)
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	switch conf.Broker.Type {
 	case "amqp":
 		conn, err := amqp091.Dial(conf.AMQP.URL)
@@ -127,6 +132,13 @@ func Run() {
 		}
 	}
 
+	var proxy *url.URL
+	if conf.Proxy != "" {
+		if proxy, err = url.Parse(conf.Proxy); err != nil {
+			logger.Fatalf("invalid proxy URL: %s", err)
+		}
+	}
+
 	r := rest.NewClient(conf.Token, strconv.FormatUint(uint64(conf.API.Version), 10))
 	r.URLHost = conf.API.Host
 	r.URLScheme = conf.API.Scheme
@@ -139,7 +151,10 @@ func Run() {
 				Intents:  int(conf.RawIntents),
 				Presence: &conf.Presence,
 			},
-			Version: conf.GatewayVersion,
+			Version:     conf.GatewayVersion,
+			Compression: gateway.Compression(conf.Compression),
+			Encoding:    gateway.Encoding(conf.Encoding),
+			Proxy:       proxy,
 		},
 		REST:       r,
 		LogLevel:   logLevel,
@@ -5,3 +5,12 @@ type Compressor interface {
 	Compress([]byte) []byte
 	Decompress([]byte) ([]byte, error)
 }
+
+// DefaultBufferSize is the default size of the buffer decompressed data is read into
+const DefaultBufferSize = 32 * 1024
+
+// Options tunes the memory used by a compression context. Zero values use the defaults.
+type Options struct {
+	// BufferSize is the size of the buffer decompressed zlib data is read into
+	BufferSize int
+}
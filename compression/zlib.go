@@ -0,0 +1,130 @@
+package compression
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+)
+
+// ErrDecompressorClosed is returned when the zlib stream can no longer be decompressed
+var ErrDecompressorClosed = errors.New("zlib stream is closed")
+
+// Zlib represents a zlib-stream de/compression context. Zero value is not valid.
+type Zlib struct {
+	cw  *zlib.Writer
+	cb  *bytes.Buffer
+	src *chanReader
+	out *bytes.Buffer
+	err error
+
+	bufferSize int
+}
+
+// NewZlib creates a valid zlib context
+func NewZlib() *Zlib {
+	return NewZlibOptions(Options{})
+}
+
+// NewZlibOptions creates a valid zlib context with the given options
+func NewZlibOptions(opts Options) *Zlib {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultBufferSize
+	}
+
+	cb := new(bytes.Buffer)
+	z := &Zlib{
+		cw: zlib.NewWriter(cb),
+		cb: cb,
+		src: &chanReader{
+			in:   make(chan []byte),
+			done: make(chan struct{}),
+		},
+		out:        new(bytes.Buffer),
+		bufferSize: opts.BufferSize,
+	}
+
+	go z.decompress()
+	return z
+}
+
+// decompress runs the zlib reader for the lifetime of the stream
+func (z *Zlib) decompress() {
+	defer close(z.src.done)
+
+	zr, err := zlib.NewReader(z.src)
+	if err != nil {
+		z.err = err
+		return
+	}
+
+	// out must only be written between reads so that Decompress can safely drain it
+	buf := make([]byte, z.bufferSize)
+	for {
+		n, err := zr.Read(buf)
+		z.out.Write(buf[:n])
+
+		if err == io.EOF {
+			err = ErrDecompressorClosed
+		}
+		if err != nil {
+			z.err = err
+			return
+		}
+	}
+}
+
+// Compress compresses the given bytes and returns the compressed form
+func (z *Zlib) Compress(d []byte) []byte {
+	z.cw.Write(d)
+	z.cw.Flush()
+
+	c := make([]byte, z.cb.Len())
+	copy(c, z.cb.Bytes())
+	z.cb.Reset()
+	return c
+}
+
+// Decompress decompresses the given bytes and returns the decompressed form. Each call must
+// contain a complete message, ending with the zlib sync flush suffix.
+func (z *Zlib) Decompress(d []byte) ([]byte, error) {
+	select {
+	case z.src.in <- d:
+	case <-z.src.done:
+		return []byte{}, z.err
+	}
+
+	// wait for the reader to consume the whole message
+	_, ok := <-z.src.done
+	if !ok {
+		return []byte{}, z.err
+	}
+
+	b := make([]byte, z.out.Len())
+	copy(b, z.out.Bytes())
+	z.out.Reset()
+	return b, nil
+}
+
+// chanReader is a reader that reads from chunks sent on a channel and signals when it has
+// exhausted each chunk
+type chanReader struct {
+	in      chan []byte
+	done    chan struct{}
+	pending []byte
+	started bool
+}
+
+func (r *chanReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if r.started {
+			r.done <- struct{}{}
+		}
+		r.started = true
+		r.pending = <-r.in
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,46 @@
+package compression
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+)
+
+// ZlibPayload de/compresses messages that are each a complete zlib stream, as sent when
+// identifying with compress enabled. Zero value is valid.
+type ZlibPayload struct{}
+
+// NewZlibPayload creates a per-message zlib context
+func NewZlibPayload() *ZlibPayload {
+	return &ZlibPayload{}
+}
+
+// Compress compresses the given bytes into a complete zlib stream
+func (ZlibPayload) Compress(d []byte) []byte {
+	b := new(bytes.Buffer)
+	w := zlib.NewWriter(b)
+	w.Write(d)
+	w.Close()
+	return b.Bytes()
+}
+
+// Decompress decompresses a complete zlib stream. Messages without a zlib header, such as
+// uncompressed ETF payloads, are returned unchanged.
+func (ZlibPayload) Decompress(d []byte) ([]byte, error) {
+	if !isZlib(d) {
+		return d, nil
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(d))
+	if err != nil {
+		return []byte{}, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// isZlib reports whether d starts with a zlib header using the deflate method
+func isZlib(d []byte) bool {
+	return len(d) >= 2 && d[0]&0x0f == 8 && (uint16(d[0])<<8|uint16(d[1]))%31 == 0
+}
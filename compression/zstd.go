@@ -12,18 +12,47 @@ type Zstd struct {
 	cr *ChanWriter
 	dw io.Writer
 	dr *ChanWriter
+
+	// done is closed with err set once the stream can no longer be decompressed
+	done chan struct{}
+	err  error
 }
 
 // NewZstd creates a valid zstd context
 func NewZstd() *Zstd {
+	return NewZstdOptions(Options{})
+}
+
+// NewZstdOptions creates a valid zstd context with the given options. None of the options apply to
+// zstd yet, since libzstd sizes the decoder's buffers by the window the sender chose.
+func NewZstdOptions(opts Options) *Zstd {
 	cr := &ChanWriter{make(chan []byte)}
 	zw := gozstd.NewWriter(cr)
 
 	dr, dw := io.Pipe()
-	zr := gozstd.NewReader(dr)
-	dChanWriter := &ChanWriter{make(chan []byte)}
-	go zr.WriteTo(dChanWriter)
-	return &Zstd{zw, cr, dw, dChanWriter}
+	z := &Zstd{
+		cw:   zw,
+		cr:   cr,
+		dw:   dw,
+		dr:   &ChanWriter{make(chan []byte)},
+		done: make(chan struct{}),
+	}
+
+	go z.decompress(gozstd.NewReader(dr), dr)
+	return z
+}
+
+// decompress runs the zstd reader for the lifetime of the stream, failing any pending write to it
+// once the reader stops
+func (z *Zstd) decompress(zr *gozstd.Reader, dr *io.PipeReader) {
+	_, err := zr.WriteTo(z.dr)
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+
+	z.err = err
+	close(z.done)
+	dr.CloseWithError(err)
 }
 
 // Compress compresses the given bytes and returns the compressed form
@@ -40,5 +69,10 @@ func (z *Zstd) Decompress(d []byte) ([]byte, error) {
 		return []byte{}, err
 	}
 
-	return <-z.dr.C, nil
+	select {
+	case b := <-z.dr.C:
+		return b, nil
+	case <-z.done:
+		return []byte{}, z.err
+	}
 }
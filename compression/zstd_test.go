@@ -0,0 +1,46 @@
+package compression
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/valyala/gozstd"
+)
+
+func TestZstdDecompress(t *testing.T) {
+	z := NewZstd()
+	want := []byte(`{"op":10,"d":{"heartbeat_interval":41250}}`)
+
+	got, err := z.Decompress(gozstd.Compress(nil, want))
+	if err != nil {
+		t.Fatalf("Decompress: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestZstdDecompressCorruptFrame(t *testing.T) {
+	z := NewZstd()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := z.Decompress([]byte("definitely not a zstd frame"))
+		errs <- err
+	}()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("Decompress of a corrupt frame succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Decompress of a corrupt frame didn't return")
+	}
+
+	// the stream can't recover, so later messages fail too
+	if _, err := z.Decompress(gozstd.Compress(nil, []byte("{}"))); err == nil {
+		t.Fatal("Decompress after a corrupt frame succeeded")
+	}
+}
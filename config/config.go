@@ -29,6 +29,9 @@ type Config struct {
 	Intents        []string
 	RawIntents     uint
 	GatewayVersion uint `toml:"gateway_version"`
+	Compression    string
+	Encoding       string
+	Proxy          string
 	Shards         struct {
 		Count int
 		IDs   []int
@@ -197,6 +200,21 @@ func (c *Config) LoadEnv() {
 		}
 	}
 
+	v = os.Getenv("DISCORD_COMPRESSION")
+	if v != "" {
+		c.Compression = v
+	}
+
+	v = os.Getenv("DISCORD_ENCODING")
+	if v != "" {
+		c.Encoding = v
+	}
+
+	v = os.Getenv("DISCORD_PROXY")
+	if v != "" {
+		c.Proxy = v
+	}
+
 	v = os.Getenv("DISCORD_SHARD_COUNT")
 	if v != "" {
 		i, err := strconv.ParseUint(v, 10, 32)
@@ -307,6 +325,9 @@ func (c *Config) String() string {
 		fmt.Sprintf("Events:      %v", c.Events),
 		fmt.Sprintf("Intents:     %v", c.Intents),
 		fmt.Sprintf("Raw intents: %d", c.RawIntents),
+		fmt.Sprintf("Compression: %s", c.Compression),
+		fmt.Sprintf("Encoding:    %s", c.Encoding),
+		fmt.Sprintf("Proxy:       %s", c.Proxy),
 		fmt.Sprintf("Shard count: %d", c.Shards.Count),
 		fmt.Sprintf("Shard IDs:   %v", c.Shards.IDs),
 		fmt.Sprintf("Broker:      %+v", c.Broker),
@@ -0,0 +1,487 @@
+// Package etf transcodes between JSON and the Erlang External Term Format used by the Discord
+// gateway. Snowflakes, which ETF transmits as big integers, are represented as JSON strings to
+// match the JSON encoding. Only unsigned integers too large for a float64 to represent exactly are
+// treated as snowflakes; every other integer remains a number.
+package etf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Term tags
+const (
+	tagVersion       = 131
+	tagNewFloat      = 70
+	tagSmallInteger  = 97
+	tagInteger       = 98
+	tagFloat         = 99
+	tagAtom          = 100
+	tagSmallTuple    = 104
+	tagLargeTuple    = 105
+	tagNil           = 106
+	tagString        = 107
+	tagList          = 108
+	tagBinary        = 109
+	tagSmallBig      = 110
+	tagLargeBig      = 111
+	tagSmallAtom     = 115
+	tagMap           = 116
+	tagAtomUTF8      = 118
+	tagSmallAtomUTF8 = 119
+)
+
+// maxExactFloat is the largest integer up to which a float64 represents every integer exactly
+var maxExactFloat = big.NewInt(1 << 53)
+
+// Errors
+var (
+	ErrInvalidVersion = errors.New("etf: invalid version")
+	ErrUnexpectedEnd  = errors.New("etf: unexpected end of input")
+)
+
+// Marshal returns the ETF encoding of v, as it would be encoded to JSON
+func Marshal(v interface{}) ([]byte, error) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromJSON(d)
+}
+
+// Unmarshal parses ETF-encoded data into v, as if it were JSON
+func Unmarshal(d []byte, v interface{}) error {
+	j, err := ToJSON(d)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(j, v)
+}
+
+// ToJSON transcodes an ETF term into JSON
+func ToJSON(d []byte) ([]byte, error) {
+	if len(d) == 0 || d[0] != tagVersion {
+		return nil, ErrInvalidVersion
+	}
+
+	dec := &decoder{d: d[1:], out: new(bytes.Buffer)}
+	if err := dec.term(); err != nil {
+		return nil, err
+	}
+	return dec.out.Bytes(), nil
+}
+
+// FromJSON transcodes JSON into an ETF term
+func FromJSON(d []byte) ([]byte, error) {
+	jd := json.NewDecoder(bytes.NewReader(d))
+	jd.UseNumber()
+
+	var v interface{}
+	if err := jd.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer([]byte{tagVersion})
+	if err := encode(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type decoder struct {
+	d   []byte
+	out *bytes.Buffer
+}
+
+func (dec *decoder) read(n int) ([]byte, error) {
+	if n < 0 || len(dec.d) < n {
+		return nil, ErrUnexpectedEnd
+	}
+
+	b := dec.d[:n]
+	dec.d = dec.d[n:]
+	return b, nil
+}
+
+func (dec *decoder) uint8() (int, error) {
+	b, err := dec.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return int(b[0]), nil
+}
+
+func (dec *decoder) uint16() (int, error) {
+	b, err := dec.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(b)), nil
+}
+
+func (dec *decoder) uint32() (int, error) {
+	b, err := dec.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+func (dec *decoder) term() error {
+	tag, err := dec.uint8()
+	if err != nil {
+		return err
+	}
+
+	switch tag {
+	case tagSmallInteger:
+		n, err := dec.uint8()
+		if err != nil {
+			return err
+		}
+		dec.out.WriteString(strconv.Itoa(n))
+
+	case tagInteger:
+		b, err := dec.read(4)
+		if err != nil {
+			return err
+		}
+		dec.out.WriteString(strconv.FormatInt(int64(int32(binary.BigEndian.Uint32(b))), 10))
+
+	case tagNewFloat:
+		b, err := dec.read(8)
+		if err != nil {
+			return err
+		}
+		dec.float(math.Float64frombits(binary.BigEndian.Uint64(b)))
+
+	case tagFloat:
+		b, err := dec.read(31)
+		if err != nil {
+			return err
+		}
+		f, err := strconv.ParseFloat(string(bytes.TrimRight(b, "\x00")), 64)
+		if err != nil {
+			return err
+		}
+		dec.float(f)
+
+	case tagAtom, tagAtomUTF8:
+		n, err := dec.uint16()
+		if err != nil {
+			return err
+		}
+		return dec.atom(n)
+
+	case tagSmallAtom, tagSmallAtomUTF8:
+		n, err := dec.uint8()
+		if err != nil {
+			return err
+		}
+		return dec.atom(n)
+
+	case tagSmallTuple:
+		n, err := dec.uint8()
+		if err != nil {
+			return err
+		}
+		return dec.array(n)
+
+	case tagLargeTuple:
+		n, err := dec.uint32()
+		if err != nil {
+			return err
+		}
+		return dec.array(n)
+
+	case tagNil:
+		dec.out.WriteString("[]")
+
+	case tagString:
+		// lists of bytes are sent as strings
+		n, err := dec.uint16()
+		if err != nil {
+			return err
+		}
+		b, err := dec.read(n)
+		if err != nil {
+			return err
+		}
+
+		dec.out.WriteByte('[')
+		for i, c := range b {
+			if i > 0 {
+				dec.out.WriteByte(',')
+			}
+			dec.out.WriteString(strconv.Itoa(int(c)))
+		}
+		dec.out.WriteByte(']')
+
+	case tagList:
+		n, err := dec.uint32()
+		if err != nil {
+			return err
+		}
+		if err = dec.array(n); err != nil {
+			return err
+		}
+
+		// proper lists end with an empty list tail, which is discarded
+		tail, err := dec.uint8()
+		if err != nil {
+			return err
+		}
+		if tail != tagNil {
+			return fmt.Errorf("etf: unsupported improper list tail %d", tail)
+		}
+
+	case tagBinary:
+		n, err := dec.uint32()
+		if err != nil {
+			return err
+		}
+		b, err := dec.read(n)
+		if err != nil {
+			return err
+		}
+		return dec.string(b)
+
+	case tagSmallBig:
+		n, err := dec.uint8()
+		if err != nil {
+			return err
+		}
+		return dec.big(n)
+
+	case tagLargeBig:
+		n, err := dec.uint32()
+		if err != nil {
+			return err
+		}
+		return dec.big(n)
+
+	case tagMap:
+		n, err := dec.uint32()
+		if err != nil {
+			return err
+		}
+
+		dec.out.WriteByte('{')
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				dec.out.WriteByte(',')
+			}
+			if err = dec.key(); err != nil {
+				return err
+			}
+			dec.out.WriteByte(':')
+			if err = dec.term(); err != nil {
+				return err
+			}
+		}
+		dec.out.WriteByte('}')
+
+	default:
+		return fmt.Errorf("etf: unsupported tag %d", tag)
+	}
+
+	return nil
+}
+
+// key writes a map key, which must be a string in JSON
+func (dec *decoder) key() error {
+	start := dec.out.Len()
+	if err := dec.term(); err != nil {
+		return err
+	}
+
+	// quote any key that isn't already a string
+	k := dec.out.Bytes()[start:]
+	if k[0] == '"' {
+		return nil
+	}
+
+	raw := string(k)
+	dec.out.Truncate(start)
+	return dec.string([]byte(raw))
+}
+
+func (dec *decoder) atom(n int) error {
+	b, err := dec.read(n)
+	if err != nil {
+		return err
+	}
+
+	switch string(b) {
+	case "nil", "null":
+		dec.out.WriteString("null")
+	case "true", "false":
+		dec.out.Write(b)
+	default:
+		return dec.string(b)
+	}
+	return nil
+}
+
+func (dec *decoder) array(n int) error {
+	dec.out.WriteByte('[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			dec.out.WriteByte(',')
+		}
+		if err := dec.term(); err != nil {
+			return err
+		}
+	}
+	dec.out.WriteByte(']')
+	return nil
+}
+
+func (dec *decoder) big(n int) error {
+	sign, err := dec.uint8()
+	if err != nil {
+		return err
+	}
+	digits, err := dec.read(n)
+	if err != nil {
+		return err
+	}
+
+	// digits are little-endian
+	be := make([]byte, n)
+	for i, d := range digits {
+		be[n-1-i] = d
+	}
+
+	i := new(big.Int).SetBytes(be)
+	if sign != 0 {
+		i.Neg(i)
+	} else if i.Cmp(maxExactFloat) > 0 {
+		return dec.string([]byte(i.String()))
+	}
+
+	dec.out.WriteString(i.String())
+	return nil
+}
+
+func (dec *decoder) float(f float64) {
+	dec.out.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+func (dec *decoder) string(b []byte) error {
+	if !utf8.Valid(b) {
+		return errors.New("etf: invalid UTF-8 in binary")
+	}
+
+	s, err := json.Marshal(string(b))
+	if err != nil {
+		return err
+	}
+	dec.out.Write(s)
+	return nil
+}
+
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		writeAtom(buf, "nil")
+
+	case bool:
+		writeAtom(buf, strconv.FormatBool(v))
+
+	case string:
+		buf.WriteByte(tagBinary)
+		binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		buf.WriteString(v)
+
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			writeInt(buf, i)
+			return nil
+		}
+
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(tagNewFloat)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+
+	case []interface{}:
+		if len(v) == 0 {
+			buf.WriteByte(tagNil)
+			return nil
+		}
+
+		buf.WriteByte(tagList)
+		binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		for _, e := range v {
+			if err := encode(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(tagNil)
+
+	case map[string]interface{}:
+		buf.WriteByte(tagMap)
+		binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		for k, e := range v {
+			if err := encode(buf, k); err != nil {
+				return err
+			}
+			if err := encode(buf, e); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("etf: unsupported type %T", v)
+	}
+
+	return nil
+}
+
+func writeAtom(buf *bytes.Buffer, atom string) {
+	buf.WriteByte(tagSmallAtomUTF8)
+	buf.WriteByte(byte(len(atom)))
+	buf.WriteString(atom)
+}
+
+func writeInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= math.MaxUint8:
+		buf.WriteByte(tagSmallInteger)
+		buf.WriteByte(byte(i))
+
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(tagInteger)
+		binary.Write(buf, binary.BigEndian, int32(i))
+
+	default:
+		sign := byte(0)
+		u := uint64(i)
+		if i < 0 {
+			sign = 1
+			u = uint64(-i)
+		}
+
+		digits := make([]byte, 0, 8)
+		for ; u > 0; u >>= 8 {
+			digits = append(digits, byte(u))
+		}
+
+		buf.WriteByte(tagSmallBig)
+		buf.WriteByte(byte(len(digits)))
+		buf.WriteByte(sign)
+		buf.Write(digits)
+	}
+}
@@ -0,0 +1,230 @@
+package etf
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// term prefixes the version tag to an encoded term
+func term(b ...byte) []byte {
+	return append([]byte{tagVersion}, b...)
+}
+
+// bigTerm encodes u as a big integer with the given tag
+func bigTerm(tag byte, neg bool, u uint64) []byte {
+	var digits []byte
+	for ; u > 0; u >>= 8 {
+		digits = append(digits, byte(u))
+	}
+
+	b := []byte{tag}
+	if tag == tagSmallBig {
+		b = append(b, byte(len(digits)))
+	} else {
+		b = append(b, uint32Bytes(uint32(len(digits)))...)
+	}
+	if neg {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	return append(b, digits...)
+}
+
+// binaryTerm encodes s as a binary
+func binaryTerm(s string) []byte {
+	return concat([]byte{tagBinary}, uint32Bytes(uint32(len(s))), []byte(s))
+}
+
+// atomTerm encodes s as an atom
+func atomTerm(s string) []byte {
+	b := []byte{tagAtom, 0, 0}
+	binary.BigEndian.PutUint16(b[1:], uint16(len(s)))
+	return append(b, s...)
+}
+
+func uint32Bytes(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func concat(bs ...[]byte) []byte {
+	var out []byte
+	for _, b := range bs {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func TestToJSON(t *testing.T) {
+	newFloat := make([]byte, 9)
+	newFloat[0] = tagNewFloat
+	binary.BigEndian.PutUint64(newFloat[1:], math.Float64bits(1.5))
+	oldFloat := make([]byte, 31)
+	copy(oldFloat, "1.50000000000000000000e+00")
+
+	tests := []struct {
+		name string
+		term []byte
+		want string
+	}{
+		{"small int", term(tagSmallInteger, 42), `42`},
+		{"int", term(tagInteger, 0xff, 0xff, 0xff, 0xfb), `-5`},
+		{"small big", term(bigTerm(tagSmallBig, false, 1700000000000)...), `1700000000000`},
+		{"negative small big", term(bigTerm(tagSmallBig, true, 3000000000)...), `-3000000000`},
+		{"large big", term(bigTerm(tagLargeBig, false, 1<<40)...), `1099511627776`},
+		{"negative big beyond float precision", term(bigTerm(tagSmallBig, true, 1<<60)...), `-1152921504606846976`},
+		{"snowflake", term(bigTerm(tagSmallBig, false, 175928847299117063)...), `"175928847299117063"`},
+		{"new float", term(newFloat...), `1.5`},
+		{"float", term(append([]byte{tagFloat}, oldFloat...)...), `1.5`},
+		{"true", term(atomTerm("true")...), `true`},
+		{"false", term(tagSmallAtomUTF8, 5, 'f', 'a', 'l', 's', 'e'), `false`},
+		{"nil atom", term(atomTerm("nil")...), `null`},
+		{"atom", term(atomTerm("READY")...), `"READY"`},
+		{"nil", term(tagNil), `[]`},
+		{"list", term(tagList, 0, 0, 0, 2, tagSmallInteger, 1, tagSmallInteger, 2, tagNil), `[1,2]`},
+		{"string", term(tagString, 0, 3, 1, 2, 3), `[1,2,3]`},
+		{"tuple", term(tagSmallTuple, 2, tagSmallInteger, 1, tagNil), `[1,[]]`},
+		{"binary", term(binaryTerm(`say "hi"`)...), `"say \"hi\""`},
+		{"map", term(concat(
+			[]byte{tagMap, 0, 0, 0, 2},
+			binaryTerm("a"), []byte{tagSmallInteger, 1},
+			atomTerm("b"), []byte{tagNil},
+		)...), `{"a":1,"b":[]}`},
+		{"map with integer key", term(tagMap, 0, 0, 0, 1, tagSmallInteger, 7, tagSmallInteger, 1), `{"7":1}`},
+		{"map with big and atom keys", term(concat(
+			[]byte{tagMap, 0, 0, 0, 2},
+			bigTerm(tagSmallBig, false, 1700000000000), []byte{tagSmallInteger, 1},
+			atomTerm("true"), []byte{tagSmallInteger, 2},
+		)...), `{"1700000000000":1,"true":2}`},
+		{"map with snowflake key", term(concat(
+			[]byte{tagMap, 0, 0, 0, 1},
+			bigTerm(tagSmallBig, false, 175928847299117063), []byte{tagSmallInteger, 1},
+		)...), `{"175928847299117063":1}`},
+	}
+
+	for _, tt := range tests {
+		got, err := ToJSON(tt.term)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestToJSONErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		term []byte
+		want error
+	}{
+		{"empty", nil, ErrInvalidVersion},
+		{"missing version", []byte{tagSmallInteger, 1}, ErrInvalidVersion},
+		{"truncated int", term(tagInteger, 0, 0), ErrUnexpectedEnd},
+		{"truncated binary", term(tagBinary, 0, 0, 0, 5, 'a'), ErrUnexpectedEnd},
+		{"truncated map", term(tagMap, 0, 0, 0, 1, tagSmallInteger, 1), ErrUnexpectedEnd},
+	}
+
+	for _, tt := range tests {
+		if _, err := ToJSON(tt.term); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	if _, err := ToJSON(term(tagList, 0, 0, 0, 1, tagSmallInteger, 1, tagSmallInteger, 2)); err == nil {
+		t.Error("improper list: got no error")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	type nested struct {
+		Name string `json:"name"`
+	}
+	type packet struct {
+		ID       string           `json:"id"`
+		Small    int              `json:"small"`
+		Int      int              `json:"int"`
+		Since    int64            `json:"since"`
+		Negative int64            `json:"negative"`
+		Float    float64          `json:"float"`
+		Bool     bool             `json:"bool"`
+		Nil      *nested          `json:"nil"`
+		List     []int            `json:"list"`
+		Map      map[string]int   `json:"map"`
+		Nested   nested           `json:"nested"`
+		Any      []interface{}    `json:"any"`
+		Objects  []map[string]int `json:"objects"`
+	}
+
+	in := packet{
+		ID:       "175928847299117063",
+		Small:    200,
+		Int:      -70000,
+		Since:    1700000000000,
+		Negative: -3000000000,
+		Float:    0.25,
+		Bool:     true,
+		List:     []int{1, 300, -1},
+		Map:      map[string]int{"a": 1, "b": 2},
+		Nested:   nested{Name: "café"},
+		Any:      []interface{}{"x", 1.5, false, nil},
+		Objects:  []map[string]int{{"c": 3}},
+	}
+
+	d, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out packet
+	if err = Unmarshal(d, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("got %+v, want %+v", out, in)
+	}
+}
+
+func TestRoundTripJSON(t *testing.T) {
+	tests := []string{
+		`0`,
+		`255`,
+		`256`,
+		`-1`,
+		`2147483648`,
+		`-2147483649`,
+		`9007199254740992`,
+		`-9007199254740993`,
+		`1.5`,
+		`true`,
+		`null`,
+		`"snowflake"`,
+		`[]`,
+		`[1,"a",[2]]`,
+		`{"a":{"b":[true,null]}}`,
+	}
+
+	for _, want := range tests {
+		d, err := FromJSON([]byte(want))
+		if err != nil {
+			t.Errorf("%s: %v", want, err)
+			continue
+		}
+
+		got, err := ToJSON(d)
+		if err != nil {
+			t.Errorf("%s: %v", want, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/spec-tacles/gateway/gateway"
+	"github.com/spec-tacles/go/rest"
+	"github.com/spec-tacles/go/types"
+)
+
+var (
+	token   = os.Getenv("TOKEN")
+	guildID = os.Getenv("GUILD_ID")
+)
+
+// correlates guild member chunks with requests by nonce, without RequestGuildMembers
+func main() {
+	c := gateway.NewShard(&gateway.ShardOptions{
+		Identify: &types.Identify{
+			Token: token,
+		},
+		Intents: gateway.IntentGuilds | gateway.IntentGuildMembers,
+	})
+
+	c.On(gateway.GatewayEventGuildMembersChunk, func(d json.RawMessage) {
+		chunk := new(gateway.GuildMembersChunk)
+		if err := json.Unmarshal(d, chunk); err != nil {
+			log.Printf("failed to decode chunk: %v", err)
+			return
+		}
+
+		log.Printf("request %q: chunk %d of %d with %d members", chunk.Nonce, chunk.ChunkIndex+1, chunk.ChunkCount, len(chunk.Members))
+	})
+
+	c.On(types.GatewayEventReady, func(json.RawMessage) {
+		// sent from another goroutine since handlers run in the read loop
+		go func() {
+			query := ""
+			err := c.SendPacket(types.GatewayOpRequestGuildMembers, &gateway.RequestGuildMembers{
+				GuildID: guildID,
+				Query:   &query,
+				Nonce:   "everyone",
+			})
+			if err != nil {
+				log.Printf("failed to request members: %v", err)
+			}
+		}()
+	})
+
+	var err error
+	c.Gateway, err = gateway.FetchGatewayBot(rest.NewClient(token, "10"))
+	if err != nil {
+		log.Panicf("failed to load gateway: %v", err)
+	}
+
+	if err := c.Open(context.Background()); err != nil {
+		log.Panicf("failed to open: %v", err)
+	}
+}
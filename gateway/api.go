@@ -3,12 +3,16 @@ package gateway
 import (
 	"io"
 	"net/http"
+)
 
-	"github.com/spec-tacles/go/types"
+// Supported Gateway versions
+const (
+	Version9  uint = 9
+	Version10 uint = 10
 )
 
 // DefaultVersion represents the default Gateway version
-const DefaultVersion uint = 10
+const DefaultVersion = Version10
 
 // Endpoints used for the Gateway
 const (
@@ -22,7 +26,7 @@ type REST interface {
 }
 
 // FetchGatewayBot fetches bot Gateway information
-func FetchGatewayBot(rest REST) (*types.GatewayBot, error) {
-	g := new(types.GatewayBot)
+func FetchGatewayBot(rest REST) (*GatewayBot, error) {
+	g := new(GatewayBot)
 	return g, rest.DoJSON(http.MethodGet, EndpointGatewayBot, nil, g)
 }
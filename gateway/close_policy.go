@@ -0,0 +1,48 @@
+package gateway
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/spec-tacles/go/types"
+)
+
+// CloseAction determines how a shard responds to its connection closing
+type CloseAction int
+
+// Close actions
+const (
+	// CloseActionResume reconnects after the usual backoff, resuming the session if possible
+	CloseActionResume CloseAction = iota
+	// CloseActionResumeNow reconnects without waiting, resuming the session if possible
+	CloseActionResumeNow
+	// CloseActionReidentify reconnects after the usual backoff with a new session
+	CloseActionReidentify
+	// CloseActionBackoff waits the maximum backoff before reconnecting
+	CloseActionBackoff
+	// CloseActionFatal stops the shard, returning a *CloseError from Open
+	CloseActionFatal
+)
+
+// DefaultClosePolicy is the action taken for each close code not overridden by ClosePolicy.
+// Unlisted codes, and connections that end without a close code, use CloseActionResume. Sessions
+// closed with 4007 or 4009 can't be resumed, since resuming them only gets an invalid session, so
+// they re-identify.
+var DefaultClosePolicy = map[int]CloseAction{
+	websocket.CloseAbnormalClosure:  CloseActionResumeNow,
+	types.CloseAuthenticationFailed: CloseActionFatal,
+	types.CloseInvalidSeq:           CloseActionReidentify,
+	types.CloseRateLimited:          CloseActionBackoff,
+	types.CloseSessionTimeout:       CloseActionReidentify,
+	types.CloseInvalidShard:         CloseActionFatal,
+	types.CloseShardingRequired:     CloseActionFatal,
+	types.CloseInvalidAPIVersion:    CloseActionFatal,
+	types.CloseInvalidIntents:       CloseActionFatal,
+	types.CloseDisallowedIntents:    CloseActionFatal,
+}
+
+// closeAction returns the action to take for the given close code
+func (s *Shard) closeAction(code int) CloseAction {
+	if action, ok := s.opts.ClosePolicy[code]; ok {
+		return action
+	}
+	return DefaultClosePolicy[code]
+}
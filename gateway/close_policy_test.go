@@ -0,0 +1,55 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/spec-tacles/go/types"
+)
+
+func TestDefaultClosePolicy(t *testing.T) {
+	tests := []struct {
+		code   int
+		action CloseAction
+		resume bool
+	}{
+		{websocket.CloseNormalClosure, CloseActionResume, true},
+		{websocket.CloseAbnormalClosure, CloseActionResumeNow, true},
+		{types.CloseUnknownError, CloseActionResume, true},
+		{types.CloseUnknownOpCode, CloseActionResume, true},
+		{types.CloseDecodeError, CloseActionResume, true},
+		{types.CloseNotAuthenticated, CloseActionResume, true},
+		{types.CloseAuthenticationFailed, CloseActionFatal, true},
+		{types.CloseAlreadyAuthenticated, CloseActionResume, true},
+		{4006, CloseActionResume, true},
+		{types.CloseInvalidSeq, CloseActionReidentify, false},
+		{types.CloseRateLimited, CloseActionBackoff, true},
+		{types.CloseSessionTimeout, CloseActionReidentify, false},
+		{types.CloseInvalidShard, CloseActionFatal, true},
+		{types.CloseShardingRequired, CloseActionFatal, true},
+		{types.CloseInvalidAPIVersion, CloseActionFatal, true},
+		{types.CloseInvalidIntents, CloseActionFatal, true},
+		{types.CloseDisallowedIntents, CloseActionFatal, true},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		s := NewShard(&ShardOptions{
+			Identify: &types.Identify{Token: "token"},
+			LogLevel: LogLevelSuppress,
+		})
+		if err := s.Restore(ctx, "session", 10); err != nil {
+			t.Fatal(err)
+		}
+
+		if action := s.handleClose(ctx, &websocket.CloseError{Code: tt.code}); action != tt.action {
+			t.Errorf("close %d: got action %d, want %d", tt.code, action, tt.action)
+		}
+
+		id, _ := s.SessionID(ctx)
+		if resume := id != ""; resume != tt.resume {
+			t.Errorf("close %d: got resume %t, want %t", tt.code, resume, tt.resume)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// coalescingConn buffers writes to a network connection once buffering starts, flushing them in a
+// single write once window has passed since the first buffered write
+type coalescingConn struct {
+	net.Conn
+	window time.Duration
+
+	mu        sync.Mutex
+	buffering bool
+	buf       []byte
+	timer     *time.Timer
+	err       error
+}
+
+func newCoalescingConn(conn net.Conn, window time.Duration) *coalescingConn {
+	return &coalescingConn{Conn: conn, window: window}
+}
+
+// startBuffering starts holding writes back. Writes are passed straight through until then, so
+// that handshakes aren't delayed.
+func (c *coalescingConn) startBuffering() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buffering = true
+}
+
+func (c *coalescingConn) Write(d []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	if !c.buffering {
+		return c.Conn.Write(d)
+	}
+
+	if len(c.buf) == 0 {
+		c.timer = time.AfterFunc(c.window, c.flush)
+	}
+	c.buf = append(c.buf, d...)
+	return len(d), nil
+}
+
+// flush writes everything buffered. A failed write closes the connection, since the writes it
+// carried were already reported as successful.
+func (c *coalescingConn) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.flushLocked(); err != nil {
+		c.Conn.Close()
+	}
+}
+
+// flushLocked is flush for callers already holding mu
+func (c *coalescingConn) flushLocked() error {
+	if c.err != nil || len(c.buf) == 0 {
+		return c.err
+	}
+
+	c.timer.Stop()
+	_, c.err = c.Conn.Write(c.buf)
+	c.buf = c.buf[:0]
+	return c.err
+}
+
+// Close writes anything still buffered, such as a close frame, before closing the connection
+func (c *coalescingConn) Close() error {
+	c.mu.Lock()
+	if len(c.buf) != 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		c.flushLocked()
+	}
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+// dial connects to the gateway. With a WriteCoalesceWindow, writes to the network are coalesced
+// once the websocket handshake is done.
+func (s *Shard) dial(ctx context.Context, url string) (*websocket.Conn, error) {
+	window := s.opts.WriteCoalesceWindow
+	if window <= 0 {
+		ws, _, err := s.opts.Dialer.DialContext(ctx, url, s.opts.RequestHeader)
+		return ws, err
+	}
+
+	var cc *coalescingConn
+	wrap := func(dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			cc = newCoalescingConn(conn, window)
+			return cc, nil
+		}
+	}
+
+	// copied so that a shared dialer isn't modified
+	d := *s.opts.Dialer
+	switch {
+	case d.NetDialContext != nil:
+		d.NetDialContext = wrap(d.NetDialContext)
+	case d.NetDial != nil:
+		netDial := d.NetDial
+		d.NetDialContext = wrap(func(_ context.Context, network, addr string) (net.Conn, error) {
+			return netDial(network, addr)
+		})
+	default:
+		d.NetDialContext = wrap((&net.Dialer{}).DialContext)
+	}
+	if d.NetDialTLSContext != nil {
+		d.NetDialTLSContext = wrap(d.NetDialTLSContext)
+	}
+
+	ws, _, err := d.DialContext(ctx, url, s.opts.RequestHeader)
+	if err != nil {
+		return nil, err
+	}
+	cc.startBuffering()
+	return ws, nil
+}
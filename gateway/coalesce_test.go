@@ -0,0 +1,95 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spec-tacles/gateway/gateway/gatewaytest"
+	"github.com/spec-tacles/go/types"
+)
+
+// countingConn counts the writes made to a network connection
+type countingConn struct {
+	net.Conn
+	writes *int64
+}
+
+func (c countingConn) Write(d []byte) (int, error) {
+	atomic.AddInt64(c.writes, 1)
+	return c.Conn.Write(d)
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	const (
+		sends  = 5
+		window = 50 * time.Millisecond
+	)
+
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	var received int64
+	srv.OnPacket = func(p *types.ReceivePacket) {
+		if p.Op == types.GatewayOpStatusUpdate {
+			atomic.AddInt64(&received, 1)
+		}
+	}
+
+	var writes int64
+	dialer := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			return countingConn{Conn: conn, writes: &writes}, err
+		},
+	}
+
+	s := newTestShard(srv, &ShardOptions{Dialer: dialer, WriteCoalesceWindow: window})
+	openTestShard(t, s)
+
+	// let the identify be written before counting
+	time.Sleep(2 * window)
+	atomic.StoreInt64(&writes, 0)
+
+	for i := 0; i < sends; i++ {
+		if err := s.SendPacket(types.GatewayOpStatusUpdate, &types.StatusUpdate{Status: string(types.PresenceStatusIdle)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "packets to be received", func() bool { return atomic.LoadInt64(&received) == sends })
+
+	if n := atomic.LoadInt64(&writes); n >= sends {
+		t.Fatalf("%d sends took %d writes", sends, n)
+	}
+}
+
+func TestCoalescingConnFlushesOnClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := newCoalescingConn(client, time.Hour)
+	c.startBuffering()
+	if _, err := c.Write([]byte("close frame")); err != nil {
+		t.Fatal(err)
+	}
+
+	read := make(chan string, 1)
+	go func() {
+		d := make([]byte, 64)
+		n, _ := server.Read(d)
+		read <- string(d[:n])
+	}()
+
+	c.Close()
+	select {
+	case d := <-read:
+		if d != "close frame" {
+			t.Fatalf("read %q after closing", d)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("buffered write wasn't flushed by closing")
+	}
+}
@@ -0,0 +1,63 @@
+package gateway
+
+import "github.com/spec-tacles/gateway/compression"
+
+// Compression represents a Gateway transport compression method
+type Compression string
+
+// Supported transport compression methods
+const (
+	CompressionZstdStream Compression = "zstd-stream"
+	CompressionZlibStream Compression = "zlib-stream"
+	CompressionNone       Compression = "none"
+)
+
+// newCompressor creates a compression context for a single connection
+func (c Compression) newCompressor(opts compression.Options) compression.Compressor {
+	switch c {
+	case CompressionZlibStream:
+		return compression.NewZlibOptions(opts)
+	case CompressionNone:
+		return nil
+	default:
+		return compression.NewZstdOptions(opts)
+	}
+}
+
+// newCompressor creates the compression context for the shard's next connection
+func (s *Shard) newCompressor() compression.Compressor {
+	if s.payloadCompression() {
+		return compression.NewZlibPayload()
+	}
+	return s.Compression().newCompressor(s.opts.CompressionOptions)
+}
+
+// payloadCompression returns whether payloads are compressed individually, which transport
+// compression takes precedence over
+func (s *Shard) payloadCompression() bool {
+	return s.opts.PayloadCompression && s.Compression() == CompressionNone
+}
+
+// fallback returns the compression method to try if this one fails
+func (c Compression) fallback() Compression {
+	switch c {
+	case CompressionZstdStream:
+		return CompressionZlibStream
+	default:
+		return CompressionNone
+	}
+}
+
+// CompressionStats totals the sizes of messages received compressed
+type CompressionStats struct {
+	CompressedBytes   uint64
+	DecompressedBytes uint64
+}
+
+// Ratio returns how many decompressed bytes were received per compressed byte
+func (s CompressionStats) Ratio() float64 {
+	if s.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(s.DecompressedBytes) / float64(s.CompressedBytes)
+}
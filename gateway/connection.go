@@ -1,33 +1,131 @@
 package gateway
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/spec-tacles/gateway/compression"
 )
 
+// closeTimeout is how long to wait for the peer to acknowledge a close frame
+const closeTimeout = time.Second
+
 // Connection wraps a websocket connection
 type Connection struct {
+	// lastPong is when the last websocket pong was received, in Unix nanoseconds
+	lastPong int64
+
 	ws         *websocket.Conn
 	compressor compression.Compressor
 	rmux       *sync.Mutex
 	wmux       *sync.Mutex
+	done       chan struct{}
+	doneOnce   sync.Once
+
+	writeTimeout time.Duration
+	readTimeout  time.Duration
+	closing      int32
+	pongTimedOut int32
+
+	// compressed and decompressed total the sizes of decompressed messages, if set
+	compressed   *uint64
+	decompressed *uint64
 }
 
-// NewConnection creates a new ReadWriteCloser wrapper around a connection
+// NewConnection creates a new ReadWriteCloser wrapper around a connection. A nil compressor
+// disables decompression of binary messages.
 func NewConnection(conn *websocket.Conn, compressor compression.Compressor) (c *Connection) {
 	return &Connection{
 		ws:         conn,
 		compressor: compressor,
 		rmux:       &sync.Mutex{},
 		wmux:       &sync.Mutex{},
+		done:       make(chan struct{}),
+	}
+}
+
+// SetWriteTimeout sets the deadline applied to each write; zero disables it
+func (c *Connection) SetWriteTimeout(timeout time.Duration) {
+	c.writeTimeout = timeout
+}
+
+// SetReadTimeout sets how long each read may wait for a message; zero disables it
+func (c *Connection) SetReadTimeout(timeout time.Duration) {
+	c.readTimeout = timeout
+}
+
+// SetReadLimit sets the maximum size of a message before decompression; zero disables it
+func (c *Connection) SetReadLimit(limit int64) {
+	c.ws.SetReadLimit(limit)
+}
+
+// SetPingInterval sends a websocket ping every interval, independent of gateway heartbeats. The
+// connection is closed if a pong isn't received before the next ping is due. Zero disables it;
+// it must be called at most once, before reading.
+func (c *Connection) SetPingInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
 	}
+
+	c.ws.SetPongHandler(func(string) error {
+		atomic.StoreInt64(&c.lastPong, time.Now().UnixNano())
+		return nil
+	})
+	go c.ping(interval)
+}
+
+// ping sends pings until the connection is closed
+func (c *Connection) ping(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	var sent int64
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+
+		if sent != 0 && atomic.LoadInt64(&c.lastPong) < sent {
+			atomic.StoreInt32(&c.pongTimedOut, 1)
+			c.terminate()
+			return
+		}
+
+		sent = time.Now().UnixNano()
+		if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+			return
+		}
+	}
+}
+
+// countCompression adds the sizes of each decompressed message to the given totals
+func (c *Connection) countCompression(compressed, decompressed *uint64) {
+	c.compressed = compressed
+	c.decompressed = decompressed
+}
+
+// CloseWithReason sends a close frame with the specified code and reason. The underlying
+// connection is closed once the peer's close frame is read, or after closeTimeout.
+func (c *Connection) CloseWithReason(code int, reason string) error {
+	atomic.StoreInt32(&c.closing, 1)
+
+	deadline := time.Now().Add(closeTimeout)
+	err := c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	c.ws.SetReadDeadline(deadline)
+	return err
 }
 
 // CloseWithCode closes the connection with the specified code
 func (c *Connection) CloseWithCode(code int) error {
-	return c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, "Normal Closure"))
+	return c.CloseWithReason(code, "Normal Closure")
 }
 
 // Close closes this connection
@@ -41,21 +139,121 @@ func (c *Connection) Write(d []byte) (int, error) {
 	c.wmux.Lock()
 	defer c.wmux.Unlock()
 
-	return len(d), c.ws.WriteMessage(websocket.BinaryMessage, d)
+	if c.writeTimeout > 0 {
+		c.ws.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+
+	// a failed write leaves the connection unusable, so close it to stop the read loop
+	err := c.ws.WriteMessage(websocket.BinaryMessage, d)
+	if err != nil {
+		c.terminate()
+	}
+	return len(d), err
+}
+
+// WriteJSON encodes v as JSON directly into a message, avoiding an intermediate copy
+func (c *Connection) WriteJSON(v interface{}) (int, error) {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	if c.writeTimeout > 0 {
+		c.ws.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+
+	w := &frameWriter{ws: c.ws}
+	err := json.NewEncoder(w).Encode(v)
+	if err == nil {
+		err = w.Close()
+	}
+
+	// a marshalling error happens before anything is written, leaving the connection usable
+	if err != nil && w.w != nil {
+		c.terminate()
+	}
+	return w.n, err
 }
 
 func (c *Connection) Read() (d []byte, err error) {
 	c.rmux.Lock()
 	defer c.rmux.Unlock()
 
+	// the close handshake has its own deadline
+	if c.readTimeout > 0 && atomic.LoadInt32(&c.closing) == 0 {
+		c.ws.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+
 	t, d, err := c.ws.ReadMessage()
 	if err != nil {
+		c.terminate()
+		if atomic.LoadInt32(&c.pongTimedOut) == 1 {
+			err = fmt.Errorf("%w: %s", ErrPongTimeout, err)
+		}
 		return
 	}
 
-	if t == websocket.BinaryMessage {
-		d, err = c.compressor.Decompress(d)
+	if t == websocket.BinaryMessage && c.compressor != nil {
+		n := len(d)
+		if d, err = c.compressor.Decompress(d); err != nil {
+			err = fmt.Errorf("%w: %s", ErrDecompressionFailed, err)
+		} else if c.compressed != nil {
+			atomic.AddUint64(c.compressed, uint64(n))
+			atomic.AddUint64(c.decompressed, uint64(len(d)))
+		}
 	}
 
 	return
 }
+
+// frameWriter writes a single message, only starting it once there's something to write
+type frameWriter struct {
+	ws *websocket.Conn
+	w  io.WriteCloser
+	n  int
+}
+
+func (w *frameWriter) Write(d []byte) (n int, err error) {
+	if w.w == nil {
+		if w.w, err = w.ws.NextWriter(websocket.BinaryMessage); err != nil {
+			return
+		}
+	}
+
+	n, err = w.w.Write(d)
+	w.n += n
+	return
+}
+
+func (w *frameWriter) Close() error {
+	if w.w == nil {
+		return nil
+	}
+	return w.w.Close()
+}
+
+// RemoteAddr returns the address of the gateway server
+func (c *Connection) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+// LocalAddr returns the local address of the connection
+func (c *Connection) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+// Subprotocol returns the websocket subprotocol negotiated in the handshake, if any
+func (c *Connection) Subprotocol() string {
+	return c.ws.Subprotocol()
+}
+
+// Done returns a channel that's closed once the underlying connection has been closed
+func (c *Connection) Done() <-chan struct{} {
+	return c.done
+}
+
+// terminate closes the underlying connection without a close handshake
+func (c *Connection) terminate() {
+	c.doneOnce.Do(func() {
+		c.ws.Close()
+		close(c.done)
+	})
+}
@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+
+	"github.com/spec-tacles/go/types"
+)
+
+// DisconnectReason classifies why a connection ended
+type DisconnectReason int
+
+// Disconnect reasons
+const (
+	DisconnectUnknown DisconnectReason = iota
+	// DisconnectNetworkError is a failed read or write without a close code
+	DisconnectNetworkError
+	// DisconnectTimeout is a zombie connection: an unacknowledged heartbeat, a missing pong, or a
+	// read timeout
+	DisconnectTimeout
+	// DisconnectRequested is a reconnect requested by Reconnect, Invalidate, or SetIntents
+	DisconnectRequested
+	// DisconnectReconnect is a reconnect requested by the gateway with op 7
+	DisconnectReconnect
+	// DisconnectInvalidSession is a resumable invalid session (op 9)
+	DisconnectInvalidSession
+	// DisconnectDecodeError is a packet that couldn't be decompressed or decoded
+	DisconnectDecodeError
+	// DisconnectAuthenticationFailed is a 4004 close
+	DisconnectAuthenticationFailed
+	// DisconnectRateLimited is a 4008 close
+	DisconnectRateLimited
+	// DisconnectSessionTimeout is a 4009 close
+	DisconnectSessionTimeout
+	// DisconnectServerClose is any other close code
+	DisconnectServerClose
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectNetworkError:
+		return "network_error"
+	case DisconnectTimeout:
+		return "timeout"
+	case DisconnectRequested:
+		return "requested"
+	case DisconnectReconnect:
+		return "reconnect"
+	case DisconnectInvalidSession:
+		return "invalid_session"
+	case DisconnectDecodeError:
+		return "decode_error"
+	case DisconnectAuthenticationFailed:
+		return "authentication_failed"
+	case DisconnectRateLimited:
+		return "rate_limited"
+	case DisconnectSessionTimeout:
+		return "session_timeout"
+	case DisconnectServerClose:
+		return "server_close"
+	default:
+		return "unknown"
+	}
+}
+
+// closeCause records why the shard closed a connection itself, and whether it ended the session
+type closeCause struct {
+	err        error
+	invalidate bool
+}
+
+// disconnectReason classifies the end of a connection from its close code and error. A close
+// initiated by the shard is classified by its cause rather than the close it provoked.
+func (s *Shard) disconnectReason(code int, err error) DisconnectReason {
+	if cause, _ := s.closeCause.Load().(closeCause); cause.err != nil {
+		err, code = cause.err, 0
+	}
+
+	var decodeErr *DecodeError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrHeartbeatUnacknowledged), errors.Is(err, ErrPongTimeout):
+		return DisconnectTimeout
+	case errors.Is(err, ErrReconnectRequested):
+		return DisconnectRequested
+	case errors.Is(err, ErrReconnectReceived):
+		return DisconnectReconnect
+	case errors.Is(err, ErrSessionInvalidated):
+		return DisconnectInvalidSession
+	case errors.Is(err, ErrDecompressionFailed), errors.As(err, &decodeErr):
+		return DisconnectDecodeError
+	}
+
+	switch code {
+	case 0:
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return DisconnectTimeout
+		}
+		if err != nil {
+			return DisconnectNetworkError
+		}
+		return DisconnectUnknown
+	case types.CloseAuthenticationFailed:
+		return DisconnectAuthenticationFailed
+	case types.CloseRateLimited:
+		return DisconnectRateLimited
+	case types.CloseSessionTimeout:
+		return DisconnectSessionTimeout
+	default:
+		return DisconnectServerClose
+	}
+}
@@ -0,0 +1,33 @@
+package gateway
+
+import (
+	"encoding/json"
+
+	"github.com/spec-tacles/gateway/etf"
+)
+
+// Encoding represents a Gateway payload encoding
+type Encoding string
+
+// Supported payload encodings
+const (
+	EncodingJSON Encoding = "json"
+	EncodingETF  Encoding = "etf"
+)
+
+// Marshal encodes a packet to be sent over the Gateway
+func (e Encoding) Marshal(v interface{}) ([]byte, error) {
+	if e == EncodingETF {
+		return etf.Marshal(v)
+	}
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes a packet received from the Gateway. Packet data is always decoded into JSON, so
+// json.RawMessage fields remain valid for either encoding.
+func (e Encoding) Unmarshal(d []byte, v interface{}) error {
+	if e == EncodingETF {
+		return etf.Unmarshal(d, v)
+	}
+	return json.Unmarshal(d, v)
+}
@@ -1,12 +1,118 @@
 package gateway
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/spec-tacles/go/types"
+)
 
 // Errors
 var (
 	ErrGatewayAbsent           = errors.New("gateway information hasn't been fetched")
+	ErrInvalidGatewayURL       = errors.New("invalid gateway URL")
 	ErrHeartbeatUnacknowledged = errors.New("heartbeat was never acknowledged")
 	ErrMaxRetriesExceeded      = errors.New("max retries exceeded")
 	ErrReconnectReceived       = errors.New("received reconnect OP code")
+	ErrReconnectRequested      = errors.New("reconnect requested")
+	ErrSessionInvalidated      = errors.New("received resumable invalid session")
 	ErrConnectionClosed        = errors.New("connection was closed")
+	ErrInvalidStatus           = errors.New("invalid presence status")
+	ErrUnsupportedVersion      = errors.New("unsupported gateway version")
+	ErrShardClosed             = errors.New("shard is closed")
+	ErrInvalidOptions          = errors.New("invalid shard options")
+	ErrShardingRequired        = errors.New("sharding required")
+	ErrDecompressionFailed     = errors.New("unable to decompress message")
+	ErrPongTimeout             = errors.New("websocket pong wasn't received in time")
+	ErrDuplicateNonce          = errors.New("a request with this nonce is already pending")
 )
+
+// maxErrorPayload is how much of an undecodable payload is included in a DecodeError
+const maxErrorPayload = 256
+
+// DecodeError represents a packet, or its data, that couldn't be decoded. Op and Event are unset
+// if the packet itself couldn't be decoded.
+type DecodeError struct {
+	Op    types.GatewayOp
+	Event types.GatewayEvent
+	// Payload is the start of the undecodable payload
+	Payload string
+
+	err error
+}
+
+func newDecodeError(op types.GatewayOp, event types.GatewayEvent, payload []byte, err error) error {
+	if len(payload) > maxErrorPayload {
+		payload = payload[:maxErrorPayload]
+	}
+
+	return &DecodeError{
+		Op:      op,
+		Event:   event,
+		Payload: string(payload),
+		err:     err,
+	}
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("unable to decode op %d %q: %s (payload %q)", e.Op, e.Event, e.err, e.Payload)
+}
+
+// Unwrap returns the underlying decoding error
+func (e *DecodeError) Unwrap() error {
+	return e.err
+}
+
+// handshakeError represents a connection refused by the gateway, or ended before HELLO, which
+// happens when the gateway can't use the requested transport compression
+type handshakeError struct {
+	err error
+}
+
+func (e *handshakeError) Error() string {
+	return fmt.Sprintf("connection failed before HELLO: %s", e.err)
+}
+
+// Unwrap returns the underlying connection error
+func (e *handshakeError) Unwrap() error {
+	return e.err
+}
+
+// CloseError represents the gateway closing the connection with a close code
+type CloseError struct {
+	Code        int
+	Reason      string
+	Recoverable bool
+
+	err error
+}
+
+// newCloseError wraps err in a CloseError if it contains a websocket close error
+func newCloseError(err error, recoverable bool) error {
+	var wsErr *websocket.CloseError
+	if !errors.As(err, &wsErr) {
+		return err
+	}
+
+	return &CloseError{
+		Code:        wsErr.Code,
+		Reason:      wsErr.Text,
+		Recoverable: recoverable,
+		err:         err,
+	}
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("gateway closed with code %d: %s", e.Code, e.Reason)
+}
+
+// Is reports whether the close matches a sentinel error; a 4011 close matches ErrShardingRequired
+func (e *CloseError) Is(target error) bool {
+	return target == ErrShardingRequired && e.Code == types.CloseShardingRequired
+}
+
+// Unwrap returns the underlying websocket error
+func (e *CloseError) Unwrap() error {
+	return e.err
+}
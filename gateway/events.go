@@ -0,0 +1,110 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/spec-tacles/go/types"
+)
+
+// BackpressurePolicy determines what a shard does when its Events channel is full
+type BackpressurePolicy int
+
+// Backpressure policies
+const (
+	// BackpressureBlock waits for room in the channel, stalling the read loop
+	BackpressureBlock BackpressurePolicy = iota
+	// BackpressureDropOldest discards the oldest queued packet to make room
+	BackpressureDropOldest
+	// BackpressureDropNewest discards the packet being delivered
+	BackpressureDropNewest
+)
+
+// deliverEvent sends a copy of the packet to the Events channel according to the backpressure
+// policy
+func (s *Shard) deliverEvent(ctx context.Context, p *types.ReceivePacket) {
+	c := s.retainPacket(p)
+
+	switch s.opts.EventsPolicy {
+	case BackpressureDropNewest:
+		select {
+		case s.opts.Events <- c:
+		default:
+			s.log(LogLevelWarn, "Events channel full: dropping op:%d t:\"%s\"", c.Op, c.Event)
+		}
+
+	case BackpressureDropOldest:
+		for {
+			select {
+			case s.opts.Events <- c:
+				return
+			default:
+			}
+
+			select {
+			case old := <-s.opts.Events:
+				s.log(LogLevelWarn, "Events channel full: dropping op:%d t:\"%s\"", old.Op, old.Event)
+			default:
+			}
+		}
+
+	default:
+		select {
+		case s.opts.Events <- c:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// eventSet converts a list of events into a set, returning nil for an empty list
+func eventSet(events []types.GatewayEvent) map[types.GatewayEvent]struct{} {
+	if len(events) == 0 {
+		return nil
+	}
+
+	set := make(map[types.GatewayEvent]struct{}, len(events))
+	for _, e := range events {
+		set[e] = struct{}{}
+	}
+	return set
+}
+
+// filtered returns whether a dispatch is excluded by AllowEvents or DenyEvents
+func (s *Shard) filtered(p *types.ReceivePacket) bool {
+	if p.Op != types.GatewayOpDispatch {
+		return false
+	}
+
+	if _, ok := s.denyEvents[p.Event]; ok {
+		return true
+	}
+
+	if s.allowEvents != nil {
+		_, ok := s.allowEvents[p.Event]
+		return !ok
+	}
+	return false
+}
+
+// EventHandler handles the data of a dispatch
+type EventHandler func(json.RawMessage)
+
+// On registers a handler that's called with the data of every dispatch of the given event. If
+// ReusePackets is enabled, handlers must not retain the data after returning.
+func (s *Shard) On(event types.GatewayEvent, handler EventHandler) {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+
+	s.handlers[event] = append(s.handlers[event], handler)
+}
+
+// dispatchEvent calls the handlers registered for the packet's event
+func (s *Shard) dispatchEvent(p *types.ReceivePacket) {
+	s.handlersMu.RLock()
+	handlers := s.handlers[p.Event]
+	s.handlersMu.RUnlock()
+
+	for _, h := range handlers {
+		s.callHandler(p, func() { h(p.Data) })
+	}
+}
@@ -0,0 +1,346 @@
+// Package gatewaytest provides a fake Discord gateway for exercising shards without connecting to
+// Discord. The server speaks uncompressed JSON, so shards must use EncodingJSON. Connections
+// requesting transport compression are refused, so shards must use CompressionNone or fall back
+// to it.
+package gatewaytest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spec-tacles/go/types"
+)
+
+// Server is a fake gateway implementing the HELLO, IDENTIFY, READY, HEARTBEAT, and RESUME
+// handshakes. Resumes replay every dispatch after the resumed sequence before RESUMED, including
+// dispatches sent while no shard was connected. Each identify starts a new session, whose sequence
+// starts again from READY, and a shard closing with 1000 or 1001 ends the session like Discord
+// does, so resuming it is rejected.
+type Server struct {
+	*httptest.Server
+
+	// HeartbeatInterval is sent in HELLO
+	HeartbeatInterval time.Duration
+
+	// ResumeURL is sent in READY as the URL to resume on, defaulting to URL
+	ResumeURL string
+
+	// OnPacket, if set, is called with every packet received from a shard
+	OnPacket func(*types.ReceivePacket)
+
+	upgrader websocket.Upgrader
+
+	mu            sync.Mutex
+	conns         map[*websocket.Conn]*sync.Mutex
+	ackDelay      time.Duration
+	dropAcks      bool
+	rejectResumes bool
+	ended         bool
+	closeCodes    []int
+	refused       []string
+	sessions      int
+	seq           types.Seq
+	dispatches    []*frame
+	accepted      int
+	identifies    int
+	resumes       int
+}
+
+// frame is a packet sent to shards
+type frame struct {
+	Op    types.GatewayOp    `json:"op"`
+	Data  interface{}        `json:"d"`
+	Seq   types.Seq          `json:"s,omitempty"`
+	Event types.GatewayEvent `json:"t,omitempty"`
+}
+
+// NewServer starts a fake gateway. Callers should Close it when finished.
+func NewServer() *Server {
+	s := &Server{
+		HeartbeatInterval: 45 * time.Second,
+		conns:             make(map[*websocket.Conn]*sync.Mutex),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// URL returns the websocket URL of the server, for use as GatewayBot.URL
+func (s *Server) URL() string {
+	return "ws" + strings.TrimPrefix(s.Server.URL, "http")
+}
+
+// SetAckDelay delays heartbeat ACKs by the given duration
+func (s *Server) SetAckDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ackDelay = d
+}
+
+// DropAcks stops acknowledging heartbeats, simulating a zombie connection
+func (s *Server) DropAcks(drop bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dropAcks = drop
+}
+
+// RejectResumes answers resumes with a non-resumable invalid session, simulating expired sessions
+func (s *Server) RejectResumes(reject bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rejectResumes = reject
+}
+
+// Connections returns how many connections have been accepted
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.accepted
+}
+
+// Identifies returns how many IDENTIFY packets have been received
+func (s *Server) Identifies() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.identifies
+}
+
+// Resumes returns how many RESUME packets have been received
+func (s *Server) Resumes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.resumes
+}
+
+// RefusedCompression returns the transport compression of each connection refused for requesting
+// it, in order
+func (s *Server) RefusedCompression() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.refused...)
+}
+
+// CloseCodes returns the codes of the close frames received from shards, in order
+func (s *Server) CloseCodes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]int(nil), s.closeCodes...)
+}
+
+// CloseWithCode closes every open connection with the given close code
+func (s *Server) CloseWithCode(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	for _, c := range s.connections() {
+		c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		c.Close()
+	}
+}
+
+// Drop closes every open connection without a close frame, which shards see as an abnormal
+// closure (1006)
+func (s *Server) Drop() {
+	for _, c := range s.connections() {
+		c.Close()
+	}
+}
+
+// Reconnect sends OP 7 to every open connection
+func (s *Server) Reconnect() {
+	s.Broadcast(types.GatewayOpReconnect, nil)
+}
+
+// InvalidateSession sends OP 9 to every open connection
+func (s *Server) InvalidateSession(resumable bool) {
+	s.Broadcast(types.GatewayOpInvalidSession, resumable)
+}
+
+// Dispatch sends a dispatch to every open connection
+func (s *Server) Dispatch(event types.GatewayEvent, data interface{}) {
+	s.mu.Lock()
+	s.seq++
+	f := &frame{Op: types.GatewayOpDispatch, Data: data, Seq: s.seq, Event: event}
+	s.dispatches = append(s.dispatches, f)
+	s.mu.Unlock()
+
+	for _, c := range s.connections() {
+		s.write(c, f)
+	}
+}
+
+// Broadcast sends a packet to every open connection
+func (s *Server) Broadcast(op types.GatewayOp, data interface{}) {
+	for _, c := range s.connections() {
+		s.write(c, &frame{Op: op, Data: data})
+	}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if compress := r.URL.Query().Get("compress"); compress != "" {
+		s.mu.Lock()
+		s.refused = append(s.refused, compress)
+		s.mu.Unlock()
+
+		http.Error(w, "unsupported compression: "+compress, http.StatusBadRequest)
+		return
+	}
+
+	c, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.conns[c] = new(sync.Mutex)
+	s.accepted++
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	s.write(c, &frame{Op: types.GatewayOpHello, Data: &types.Hello{
+		HeartbeatInterval: s.HeartbeatInterval.Milliseconds(),
+	}})
+
+	for {
+		_, d, err := c.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				s.mu.Lock()
+				s.closeCodes = append(s.closeCodes, closeErr.Code)
+				if closeErr.Code == websocket.CloseNormalClosure || closeErr.Code == websocket.CloseGoingAway {
+					s.ended = true
+				}
+				s.mu.Unlock()
+			}
+			return
+		}
+
+		p := new(types.ReceivePacket)
+		if err = json.Unmarshal(d, p); err != nil {
+			return
+		}
+
+		if s.OnPacket != nil {
+			s.OnPacket(p)
+		}
+
+		s.handle(c, p)
+	}
+}
+
+func (s *Server) handle(c *websocket.Conn, p *types.ReceivePacket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch p.Op {
+	case types.GatewayOpHeartbeat:
+		if s.dropAcks {
+			return
+		}
+
+		delay := s.ackDelay
+		go func() {
+			time.Sleep(delay)
+			s.write(c, &frame{Op: types.GatewayOpHeartbeatACK})
+		}()
+
+	case types.GatewayOpIdentify:
+		resumeURL := s.ResumeURL
+		if resumeURL == "" {
+			resumeURL = s.URL()
+		}
+
+		// a new session has its own sequence
+		s.identifies++
+		s.sessions++
+		s.seq = 1
+		s.dispatches = nil
+		s.ended = false
+
+		go s.write(c, &frame{
+			Op:    types.GatewayOpDispatch,
+			Event: types.GatewayEventReady,
+			Seq:   s.seq,
+			Data: map[string]interface{}{
+				"v":                  10,
+				"session_id":         "session-" + strconv.Itoa(s.sessions),
+				"resume_gateway_url": resumeURL,
+			},
+		})
+
+	case types.GatewayOpResume:
+		s.resumes++
+		if s.rejectResumes || s.ended {
+			go s.write(c, &frame{Op: types.GatewayOpInvalidSession, Data: false})
+			return
+		}
+
+		r := new(types.Resume)
+		json.Unmarshal(p.Data, r)
+
+		var replay []*frame
+		for _, f := range s.dispatches {
+			if f.Seq > r.Seq {
+				replay = append(replay, f)
+			}
+		}
+
+		s.seq++
+		replay = append(replay, &frame{
+			Op:    types.GatewayOpDispatch,
+			Event: types.GatewayEventResumed,
+			Seq:   s.seq,
+			Data:  map[string]interface{}{},
+		})
+
+		go func() {
+			for _, f := range replay {
+				s.write(c, f)
+			}
+		}()
+	}
+}
+
+// write sends a packet, serializing writes to the connection
+func (s *Server) write(c *websocket.Conn, f *frame) {
+	s.mu.Lock()
+	mu, ok := s.conns[c]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.WriteJSON(f)
+}
+
+func (s *Server) connections() []*websocket.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]*websocket.Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
@@ -0,0 +1,152 @@
+package gateway
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spec-tacles/go/types"
+)
+
+// memberRequestTimeout bounds member requests whose context has no deadline, so that requests
+// which never receive their last chunk don't stay pending forever
+const memberRequestTimeout = time.Minute
+
+// memberRequest is a pending request for guild members awaiting its chunks. Chunks are queued by
+// the read loop and delivered by the request's own goroutine, so that slow receivers can't stall
+// packet handling.
+type memberRequest struct {
+	mu     sync.Mutex
+	queued []*GuildMembersChunk
+	last   bool
+	ready  chan struct{}
+}
+
+// push queues a chunk for delivery, without waiting for it to be delivered
+func (r *memberRequest) push(chunk *GuildMembersChunk, last bool) {
+	r.mu.Lock()
+	r.queued = append(r.queued, chunk)
+	r.last = last
+	r.mu.Unlock()
+
+	select {
+	case r.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take removes the queued chunks, reporting whether the last chunk is among them
+func (r *memberRequest) take() ([]*GuildMembersChunk, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	queued := r.queued
+	r.queued = nil
+	return queued, r.last
+}
+
+// RequestGuildMembers requests members of a guild. Each chunk of the response is delivered on the
+// returned channel, which is closed after the last chunk or once the context is done. Requests
+// without a deadline time out after a minute. Chunks are queued until they're received, so slow
+// receivers don't delay packet handling. ErrDuplicateNonce is returned if a request with the same
+// nonce is still pending.
+func (s *Shard) RequestGuildMembers(ctx context.Context, req *RequestGuildMembers) (<-chan *GuildMembersChunk, error) {
+	// copied so that the caller's request isn't given a nonce
+	packet := *req
+	if packet.Nonce == "" {
+		packet.Nonce = s.id + "-" + strconv.FormatUint(atomic.AddUint64(&s.nonce, 1), 36)
+	}
+
+	var cancel context.CancelFunc
+	if _, ok := ctx.Deadline(); ok {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithTimeout(ctx, memberRequestTimeout)
+	}
+
+	r := &memberRequest{ready: make(chan struct{}, 1)}
+
+	s.memberRequestsMu.Lock()
+	if _, ok := s.memberRequests[packet.Nonce]; ok {
+		s.memberRequestsMu.Unlock()
+		cancel()
+		return nil, ErrDuplicateNonce
+	}
+	s.memberRequests[packet.Nonce] = r
+	s.memberRequestsMu.Unlock()
+
+	chunks := make(chan *GuildMembersChunk)
+	go func() {
+		defer cancel()
+		defer close(chunks)
+		s.deliverMemberChunks(ctx, packet.Nonce, r, chunks)
+	}()
+
+	if err := s.SendPacket(types.GatewayOpRequestGuildMembers, &packet); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return chunks, nil
+}
+
+// deliverMemberChunks sends queued chunks until the last one has been sent or the context is done
+func (s *Shard) deliverMemberChunks(ctx context.Context, nonce string, r *memberRequest, chunks chan<- *GuildMembersChunk) {
+	// removed here too in case the last chunk never arrived
+	defer s.removeMemberRequest(nonce, r)
+
+	for {
+		select {
+		case <-r.ready:
+		case <-ctx.Done():
+			return
+		}
+
+		queued, last := r.take()
+		for _, chunk := range queued {
+			select {
+			case chunks <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if last {
+			return
+		}
+	}
+}
+
+// handleGuildMembersChunk routes a guild members chunk to the request with a matching nonce
+func (s *Shard) handleGuildMembersChunk(p *types.ReceivePacket) (err error) {
+	chunk := new(GuildMembersChunk)
+	if err = unmarshalData(p, chunk); err != nil || chunk.Nonce == "" {
+		return
+	}
+
+	last := chunk.ChunkIndex >= chunk.ChunkCount-1
+
+	s.memberRequestsMu.Lock()
+	r, ok := s.memberRequests[chunk.Nonce]
+	// removed with the last chunk so that the nonce can be reused straight away
+	if ok && last {
+		delete(s.memberRequests, chunk.Nonce)
+	}
+	s.memberRequestsMu.Unlock()
+
+	if ok {
+		r.push(chunk, last)
+	}
+	return
+}
+
+// removeMemberRequest removes a pending request, if it hasn't already been
+func (s *Shard) removeMemberRequest(nonce string, r *memberRequest) {
+	s.memberRequestsMu.Lock()
+	defer s.memberRequestsMu.Unlock()
+
+	if s.memberRequests[nonce] == r {
+		delete(s.memberRequests, nonce)
+	}
+}
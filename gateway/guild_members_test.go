@@ -0,0 +1,143 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spec-tacles/gateway/gateway/gatewaytest"
+	"github.com/spec-tacles/go/types"
+)
+
+func TestRequestGuildMembers(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	nonces := make(chan string, 1)
+	srv.OnPacket = func(p *types.ReceivePacket) {
+		if p.Op != types.GatewayOpRequestGuildMembers {
+			return
+		}
+		req := new(RequestGuildMembers)
+		if err := json.Unmarshal(p.Data, req); err != nil {
+			t.Error(err)
+		}
+		nonces <- req.Nonce
+	}
+
+	s := newTestShard(srv, &ShardOptions{})
+	openTestShard(t, s)
+
+	req := &RequestGuildMembers{GuildID: "1"}
+	chunks, err := s.RequestGuildMembers(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Nonce != "" {
+		t.Fatalf("caller's request was given nonce %q", req.Nonce)
+	}
+
+	var nonce string
+	select {
+	case nonce = <-nonces:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the request")
+	}
+	if nonce == "" {
+		t.Fatal("request was sent without a nonce")
+	}
+
+	for i := 0; i < 2; i++ {
+		srv.Dispatch(GatewayEventGuildMembersChunk, &GuildMembersChunk{
+			GuildID:    "1",
+			ChunkIndex: i,
+			ChunkCount: 2,
+			Nonce:      nonce,
+		})
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-chunks:
+			if c.ChunkIndex != i {
+				t.Fatalf("got chunk %d, want %d", c.ChunkIndex, i)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("timed out waiting for chunk %d", i)
+		}
+	}
+
+	select {
+	case _, ok := <-chunks:
+		if ok {
+			t.Fatal("got a chunk after the last one")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("chunks weren't closed after the last one")
+	}
+}
+
+func TestSlowMemberRequestDoesNotStallReads(t *testing.T) {
+	const chunkCount = 3
+
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	var dispatched int64
+	s := newTestShard(srv, &ShardOptions{OnPacket: func(p *types.ReceivePacket) {
+		if p.Event == "MESSAGE_CREATE" {
+			atomic.AddInt64(&dispatched, 1)
+		}
+	}})
+	openTestShard(t, s)
+
+	chunks, err := s.RequestGuildMembers(context.Background(), &RequestGuildMembers{GuildID: "1", Nonce: "slow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// none of the chunks are received until packets after them have been handled
+	for i := 0; i < chunkCount; i++ {
+		srv.Dispatch(GatewayEventGuildMembersChunk, &GuildMembersChunk{ChunkIndex: i, ChunkCount: chunkCount, Nonce: "slow"})
+	}
+	srv.Dispatch("MESSAGE_CREATE", map[string]string{"id": "1"})
+	waitFor(t, "dispatch after the chunks", func() bool { return atomic.LoadInt64(&dispatched) == 1 })
+
+	var received int
+	for range chunks {
+		received++
+	}
+	if received != chunkCount {
+		t.Fatalf("got %d chunks, want %d", received, chunkCount)
+	}
+}
+
+func TestRequestGuildMembersDuplicateNonce(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	s := newTestShard(srv, &ShardOptions{})
+	openTestShard(t, s)
+
+	ctx := context.Background()
+	req := &RequestGuildMembers{GuildID: "1", Nonce: "nonce"}
+	chunks, err := s.RequestGuildMembers(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.RequestGuildMembers(ctx, req); !errors.Is(err, ErrDuplicateNonce) {
+		t.Fatalf("got %v for a pending nonce, want ErrDuplicateNonce", err)
+	}
+
+	srv.Dispatch(GatewayEventGuildMembersChunk, &GuildMembersChunk{ChunkCount: 1, Nonce: "nonce"})
+	for range chunks {
+	}
+
+	// the nonce is free again once its request is finished
+	if _, err = s.RequestGuildMembers(ctx, req); err != nil {
+		t.Fatalf("got %v reusing a finished nonce", err)
+	}
+}
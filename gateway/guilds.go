@@ -0,0 +1,64 @@
+package gateway
+
+import "github.com/spec-tacles/go/types"
+
+// guildStub is the part of a guild payload needed to track the shard's guilds
+type guildStub struct {
+	ID          string `json:"id"`
+	Unavailable bool   `json:"unavailable"`
+}
+
+// GuildCount returns how many guilds the shard is responsible for, including unavailable ones.
+// It's only tracked if TrackGuilds is set.
+func (s *Shard) GuildCount() int {
+	s.guildsMu.Lock()
+	defer s.guildsMu.Unlock()
+	return len(s.guilds)
+}
+
+// trackGuilds updates the shard's guilds from READY, GUILD_CREATE, and GUILD_DELETE
+func (s *Shard) trackGuilds(p *types.ReceivePacket) error {
+	switch p.Event {
+	case types.GatewayEventReady:
+		r := new(struct {
+			Guilds []guildStub `json:"guilds"`
+		})
+		if err := unmarshalData(p, r); err != nil {
+			return err
+		}
+
+		guilds := make(map[string]struct{}, len(r.Guilds))
+		for _, g := range r.Guilds {
+			guilds[g.ID] = struct{}{}
+		}
+
+		s.guildsMu.Lock()
+		s.guilds = guilds
+		s.guildsMu.Unlock()
+
+	case GatewayEventGuildCreate:
+		g := new(guildStub)
+		if err := unmarshalData(p, g); err != nil {
+			return err
+		}
+
+		s.guildsMu.Lock()
+		s.guilds[g.ID] = struct{}{}
+		s.guildsMu.Unlock()
+
+	case GatewayEventGuildDelete:
+		g := new(guildStub)
+		if err := unmarshalData(p, g); err != nil {
+			return err
+		}
+
+		// unavailable guilds are in an outage, but still belong to the shard
+		if !g.Unavailable {
+			s.guildsMu.Lock()
+			delete(s.guilds, g.ID)
+			s.guildsMu.Unlock()
+		}
+	}
+
+	return nil
+}
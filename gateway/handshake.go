@@ -0,0 +1,43 @@
+package gateway
+
+import "time"
+
+// Handshake describes how a connection was established
+type Handshake struct {
+	// Dial is how long the websocket connection took to open
+	Dial time.Duration
+	// Hello is how long after dialing began HELLO was received
+	Hello time.Duration
+	// Ready is how long after dialing began READY or RESUMED was received
+	Ready time.Duration
+	// Trace lists the gateway servers that handled the session, as sent in READY or RESUMED
+	Trace []string
+}
+
+// Handshake returns the handshake of the current or most recent session
+func (s *Shard) Handshake() Handshake {
+	h, _ := s.handshake.Load().(Handshake)
+	return h
+}
+
+// beginHandshake starts timing a new connection attempt
+func (s *Shard) beginHandshake() {
+	s.handshakeStart = time.Now()
+	s.pendingHandshake = Handshake{}
+}
+
+// completeHandshake records the handshake once the session is ready
+func (s *Shard) completeHandshake(trace []string) {
+	h := s.pendingHandshake
+	h.Ready = time.Since(s.handshakeStart)
+	if len(trace) > 0 {
+		h.Trace = trace
+	}
+
+	s.handshake.Store(h)
+	s.log(LogLevelDebug, "Handshake took %s (dial %s, hello %s)", h.Ready, h.Dial, h.Hello)
+
+	if s.opts.OnHandshake != nil {
+		s.opts.OnHandshake(s.opts.Identify.Shard[0], h)
+	}
+}
@@ -0,0 +1,34 @@
+package gateway
+
+import "github.com/spec-tacles/go/types"
+
+// recordPacket adds the packet to the history of recent packets, if enabled
+func (s *Shard) recordPacket(p *types.ReceivePacket) {
+	if s.opts.PacketHistory <= 0 {
+		return
+	}
+
+	c := s.retainPacket(p)
+
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	if len(s.history) < s.opts.PacketHistory {
+		s.history = append(s.history, c)
+		return
+	}
+
+	s.history[s.historyNext] = c
+	s.historyNext = (s.historyNext + 1) % len(s.history)
+}
+
+// RecentPackets returns the most recently received packets, oldest first. PacketHistory must be
+// set for packets to be recorded.
+func (s *Shard) RecentPackets() []*types.ReceivePacket {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	packets := make([]*types.ReceivePacket, 0, len(s.history))
+	packets = append(packets, s.history[s.historyNext:]...)
+	return append(packets, s.history[:s.historyNext]...)
+}
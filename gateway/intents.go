@@ -0,0 +1,63 @@
+package gateway
+
+import "github.com/spec-tacles/go/types"
+
+// Intents represents a set of Gateway intents
+type Intents uint
+
+// Gateway intents
+const (
+	IntentGuilds                      = Intents(types.IntentGuilds)
+	IntentGuildMembers                = Intents(types.IntentGuildMembers)
+	IntentGuildBans                   = Intents(types.IntentGuildBans)
+	IntentGuildEmojis                 = Intents(types.IntentGuildEmojis)
+	IntentGuildIntegrations           = Intents(types.IntentGuildIntegrations)
+	IntentGuildWebhooks               = Intents(types.IntentGuildWebhooks)
+	IntentGuildInvites                = Intents(types.IntentGuildInvites)
+	IntentGuildVoiceStates            = Intents(types.IntentGuildVoiceStates)
+	IntentGuildPresences              = Intents(types.IntentGuildPresences)
+	IntentGuildMessages               = Intents(types.IntentGuildMessages)
+	IntentGuildMessageReactions       = Intents(types.IntentGuildMessageReactions)
+	IntentGuildMessageTyping          = Intents(types.IntentGuildMessageTyping)
+	IntentDirectMessages              = Intents(types.IntentDirectMessages)
+	IntentDirectMessageReactions      = Intents(types.IntentDirectMessageReactions)
+	IntentDirectMessageTyping         = Intents(types.IntentDirectMessageTyping)
+	IntentMessageContent              = Intents(types.IntentMessageContent)
+	IntentGuildScheduledEvents        = Intents(types.IntentGuildScheduledEvents)
+	IntentAutoModerationConfiguration = Intents(types.IntentAutoModerationConfiguration)
+	IntentAutoModerationExecution     = Intents(types.IntentAutoModerationExecution)
+
+	// IntentsAll is every known intent
+	IntentsAll = IntentGuilds | IntentGuildMembers | IntentGuildBans | IntentGuildEmojis |
+		IntentGuildIntegrations | IntentGuildWebhooks | IntentGuildInvites | IntentGuildVoiceStates |
+		IntentGuildPresences | IntentGuildMessages | IntentGuildMessageReactions |
+		IntentGuildMessageTyping | IntentDirectMessages | IntentDirectMessageReactions |
+		IntentDirectMessageTyping | IntentMessageContent | IntentGuildScheduledEvents |
+		IntentAutoModerationConfiguration | IntentAutoModerationExecution
+)
+
+// Add returns the intents with the given intents added
+func (i Intents) Add(intents ...Intents) Intents {
+	for _, intent := range intents {
+		i |= intent
+	}
+	return i
+}
+
+// Remove returns the intents with the given intents removed
+func (i Intents) Remove(intents ...Intents) Intents {
+	for _, intent := range intents {
+		i &^= intent
+	}
+	return i
+}
+
+// Has returns whether all of the given intents are set
+func (i Intents) Has(intents ...Intents) bool {
+	for _, intent := range intents {
+		if i&intent != intent {
+			return false
+		}
+	}
+	return true
+}
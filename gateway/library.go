@@ -0,0 +1,41 @@
+package gateway
+
+import "runtime/debug"
+
+// Library identity
+const (
+	LibraryName = "spectacles"
+	LibraryURL  = "https://github.com/spec-tacles/gateway"
+	libraryPath = "github.com/spec-tacles/gateway"
+)
+
+// DefaultLibrary identifies this library and the version it was built at
+var DefaultLibrary = LibraryName + "/" + libraryVersion()
+
+// libraryVersion returns the module version this library was built at, if known
+func libraryVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+
+	m := &bi.Main
+	for _, dep := range bi.Deps {
+		if dep.Path == libraryPath {
+			m = dep
+		}
+	}
+	if m.Path != libraryPath || m.Version == "" || m.Version == "(devel)" {
+		return "devel"
+	}
+
+	if m.Replace != nil && m.Replace.Version != "" {
+		return m.Replace.Version
+	}
+	return m.Version
+}
+
+// userAgent returns the User-Agent identifying the library to Discord
+func userAgent(library string) string {
+	return library + " (" + LibraryURL + ")"
+}
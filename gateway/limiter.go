@@ -1,6 +1,7 @@
 package gateway
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,6 +12,13 @@ type Limiter interface {
 	Lock()
 }
 
+// ContextLimiter is implemented by limiters that can stop waiting once a context is done, without
+// taking the lock
+type ContextLimiter interface {
+	Limiter
+	LockContext(ctx context.Context) error
+}
+
 // DefaultLimiter is a limiter that works locally
 type DefaultLimiter struct {
 	limit    *int32
@@ -36,18 +44,77 @@ func NewDefaultLimiter(limit int32, duration time.Duration) Limiter {
 
 // Lock establishes a ratelimited lock on the limiter
 func (l *DefaultLimiter) Lock() {
-	now := time.Now().UnixNano()
+	l.LockContext(context.Background())
+}
+
+// LockContext is Lock, except that it stops waiting once the context is done, returning ctx.Err()
+// without taking the lock
+func (l *DefaultLimiter) LockContext(ctx context.Context) error {
+	for {
+		now := time.Now().UnixNano()
+
+		if atomic.LoadInt64(l.resetsAt) <= now {
+			atomic.StoreInt64(l.resetsAt, now+atomic.LoadInt64(l.duration))
+			atomic.StoreInt32(l.available, atomic.LoadInt32(l.limit))
+		}
 
-	if atomic.LoadInt64(l.resetsAt) <= now {
-		atomic.StoreInt64(l.resetsAt, now+atomic.LoadInt64(l.duration))
-		atomic.StoreInt32(l.available, atomic.LoadInt32(l.limit))
+		if atomic.LoadInt32(l.available) > 0 {
+			atomic.AddInt32(l.available, -1)
+			return nil
+		}
+
+		t := time.NewTimer(time.Duration(atomic.LoadInt64(l.resetsAt) - now))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
 	}
+}
 
-	if atomic.LoadInt32(l.available) <= 0 {
-		time.Sleep(time.Duration(atomic.LoadInt64(l.resetsAt) - now))
+// lockContext waits for the limiter, returning early if the context is done. Limiters that aren't
+// a ContextLimiter still take the lock once they allow it, even if the context was done first.
+func lockContext(ctx context.Context, l Limiter) error {
+	if cl, ok := l.(ContextLimiter); ok {
+		return cl.LockContext(ctx)
+	}
+
+	locked := make(chan struct{})
+	go func() {
 		l.Lock()
-		return
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
+
+// BucketLimiter coordinates identifies between shards. Shards are grouped into max_concurrency
+// buckets by shard ID, and each bucket allows one identify per duration.
+type BucketLimiter struct {
+	buckets []Limiter
+}
+
+// NewBucketLimiter creates a bucket limiter for the given max_concurrency
+func NewBucketLimiter(concurrency int, duration time.Duration) *BucketLimiter {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	buckets := make([]Limiter, concurrency)
+	for i := range buckets {
+		buckets[i] = NewDefaultLimiter(1, duration)
+	}
+
+	return &BucketLimiter{buckets}
+}
 
-	atomic.AddInt32(l.available, -1)
+// Bucket returns the limiter of the bucket the given shard belongs to
+func (l *BucketLimiter) Bucket(shardID int) Limiter {
+	return l.buckets[shardID%len(l.buckets)]
 }
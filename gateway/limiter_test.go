@@ -0,0 +1,36 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockContextKeepsCancelledLocks(t *testing.T) {
+	const (
+		limit    = 2
+		interval = 100 * time.Millisecond
+	)
+
+	l := NewDefaultLimiter(limit, interval)
+	for i := 0; i < limit; i++ {
+		l.Lock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), interval/10)
+	defer cancel()
+	if err := lockContext(ctx, l); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v waiting on an exhausted limiter, want context.DeadlineExceeded", err)
+	}
+
+	// the abandoned wait mustn't take any of the locks available after the reset
+	time.Sleep(interval)
+	start := time.Now()
+	for i := 0; i < limit; i++ {
+		l.Lock()
+	}
+	if elapsed := time.Since(start); elapsed > interval/2 {
+		t.Fatalf("taking %d locks after the reset took %s", limit, elapsed)
+	}
+}
@@ -1,6 +1,7 @@
 package gateway
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strings"
@@ -18,6 +19,12 @@ const (
 // DefaultLogger is the default logger from which each child logger is derived
 var DefaultLogger = log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
 
+// LogHandler receives leveled log messages, allowing them to be routed to a structured logger.
+// Context is provided as alternating keys and values, such as "shard", 0.
+type LogHandler interface {
+	Log(level int, msg string, keyvals ...interface{})
+}
+
 // ChildLogger creates a child logger with the specified prefix
 func ChildLogger(parent *log.Logger, prefix string) *log.Logger {
 	return log.New(parent.Writer(), parent.Prefix()+prefix+" ", parent.Flags())
@@ -28,15 +35,25 @@ func (s *Shard) log(level int, format string, args ...interface{}) {
 		return
 	}
 
+	if s.opts.LogHandler != nil {
+		keyvals := []interface{}{"shard", s.opts.Identify.Shard[0]}
+		if len(s.opts.Identify.Shard) > 1 {
+			keyvals = append(keyvals, "shard_count", s.opts.Identify.Shard[1])
+		}
+		s.opts.LogHandler.Log(level, fmt.Sprintf(format, args...), keyvals...)
+		return
+	}
+
 	s.opts.Logger.Printf(format+"\n", args...)
 }
 
 func (s *Shard) logTrace(trace []string) {
-	if LogLevelDebug > s.opts.LogLevel {
+	if s.opts.TraceHandler != nil {
+		s.opts.TraceHandler(s.opts.Identify.Shard[0], trace)
 		return
 	}
 
-	s.opts.Logger.Printf("Trace: %s\n", strings.Join(trace, " -> "))
+	s.log(LogLevelDebug, "Trace: %s", strings.Join(trace, " -> "))
 }
 
 func (s *Manager) log(level int, format string, args ...interface{}) {
@@ -44,5 +61,10 @@ func (s *Manager) log(level int, format string, args ...interface{}) {
 		return
 	}
 
+	if s.opts.LogHandler != nil {
+		s.opts.LogHandler.Log(level, fmt.Sprintf(format, args...))
+		return
+	}
+
 	s.opts.Logger.Printf(format+"\n", args...)
 }
@@ -3,8 +3,10 @@ package gateway
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/spec-tacles/gateway/stats"
 	"github.com/spec-tacles/go/broker"
@@ -17,12 +19,24 @@ type RepublishPacket struct {
 	Packet  *types.SendPacket
 }
 
+// ShardPacket represents a packet received by one of a manager's shards
+type ShardPacket struct {
+	ShardID int
+	Packet  *types.ReceivePacket
+}
+
+// restartDelay is how long the manager waits before restarting a shard that exited
+const restartDelay = 5 * time.Second
+
 // Manager manages Gateway shards
 type Manager struct {
 	Shards      map[int]*Shard
-	Gateway     *types.GatewayBot
+	Gateway     *GatewayBot
 	opts        *ManagerOptions
+	shardsMu    sync.RWMutex
 	gatewayLock sync.Mutex
+	buckets     *BucketLimiter
+	bucketsOnce sync.Once
 }
 
 // NewManager creates a new Gateway manager
@@ -41,10 +55,10 @@ func (m *Manager) Start(ctx context.Context) (err error) {
 	if m.opts.ShardCount == 0 {
 		m.log(LogLevelDebug, "Shard count unspecified: using Discord recommended value")
 
-		var g *types.GatewayBot
+		var g *GatewayBot
 		g, err = m.FetchGateway()
 		if err != nil {
-			m.log(LogLevelError, "Failed to fetch gateway info", err)
+			m.log(LogLevelError, "Failed to fetch gateway info: %s", err)
 			return
 		}
 
@@ -68,12 +82,7 @@ func (m *Manager) Start(ctx context.Context) (err error) {
 			stats.TotalShards.Add(1)
 			defer stats.TotalShards.Sub(1)
 
-			err := m.Spawn(ctx, id)
-			if err != nil {
-				m.log(LogLevelError, "Fatal error in shard %d: %s", id, err)
-			} else {
-				m.log(LogLevelDebug, "Shard %d closing gracefully", id)
-			}
+			m.supervise(ctx, id)
 		}()
 	}
 
@@ -81,7 +90,63 @@ func (m *Manager) Start(ctx context.Context) (err error) {
 	return
 }
 
-// Spawn a new shard with the specified ID
+// supervise spawns the shard with the specified ID, restarting it whenever it exits unless the
+// context is done, the shard was closed, or the session can't be recovered
+func (m *Manager) supervise(ctx context.Context, id int) {
+	for {
+		err := m.Spawn(ctx, id)
+		if ctx.Err() != nil {
+			m.log(LogLevelDebug, "Shard %d closing gracefully", id)
+			return
+		}
+
+		// only closing the shard stops it without an error
+		if err == nil {
+			m.log(LogLevelInfo, "Shard %d was closed: not restarting it", id)
+			return
+		}
+
+		if errors.Is(err, ErrShardingRequired) {
+			m.log(LogLevelError, "Shard %d requires more shards: %s", id, err)
+			if m.opts.OnShardingRequired != nil {
+				m.opts.OnShardingRequired(id)
+			}
+			return
+		}
+
+		var closeErr *CloseError
+		if errors.As(err, &closeErr) && !closeErr.Recoverable || errors.Is(err, ErrInvalidOptions) ||
+			errors.Is(err, ErrGatewayAbsent) || errors.Is(err, ErrInvalidGatewayURL) {
+			m.log(LogLevelError, "Fatal error in shard %d: %s", id, err)
+			return
+		}
+
+		m.log(LogLevelWarn, "Shard %d exited, restarting in %s: %s", id, restartDelay, err)
+		select {
+		case <-time.After(restartDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Shard returns the shard with the specified ID, or nil if it hasn't been spawned
+func (m *Manager) Shard(id int) *Shard {
+	m.shardsMu.RLock()
+	defer m.shardsMu.RUnlock()
+
+	return m.Shards[id]
+}
+
+// State returns the state of the shard with the specified ID
+func (m *Manager) State(id int) ShardState {
+	if s := m.Shard(id); s != nil {
+		return s.State()
+	}
+	return ShardStateClosed
+}
+
+// Spawn a new shard with the specified ID, returning once it stops as Open does
 func (m *Manager) Spawn(ctx context.Context, id int) (err error) {
 	g, err := m.FetchGateway()
 	if err != nil {
@@ -91,41 +156,72 @@ func (m *Manager) Spawn(ctx context.Context, id int) (err error) {
 	opts := m.opts.ShardOptions.clone()
 	opts.Identify.Shard = []int{id, m.opts.ShardCount}
 	opts.LogLevel = m.opts.LogLevel
-	opts.IdentifyLimiter = m.opts.ShardLimiter
+	opts.IdentifyLimiter = m.shardLimiter(g, id)
 	if opts.Logger == nil {
 		opts.Logger = m.opts.Logger
 	}
+	if opts.LogHandler == nil {
+		opts.LogHandler = m.opts.LogHandler
+	}
 
-	if m.opts.OnPacket != nil {
+	var s *Shard
+	if m.opts.OnPacket != nil || m.opts.Events != nil {
 		opts.OnPacket = func(r *types.ReceivePacket) {
-			m.opts.OnPacket(id, r)
+			if m.opts.OnPacket != nil {
+				m.opts.OnPacket(id, r)
+			}
+
+			if m.opts.Events != nil {
+				m.opts.Events <- ShardPacket{ShardID: id, Packet: s.retainPacket(r)}
+			}
 		}
 	}
 
-	s := NewShard(opts)
+	s = NewShard(opts)
 	s.Gateway = g
+
+	m.shardsMu.Lock()
 	m.Shards[id] = s
+	m.shardsMu.Unlock()
 
-	err = s.Open(ctx)
-	if err != nil {
-		return
+	return s.Open(ctx)
+}
+
+// shardLimiter returns the limiter that gates identifies for the given shard
+func (m *Manager) shardLimiter(g *GatewayBot, id int) Limiter {
+	if m.opts.ShardLimiter != nil {
+		return m.opts.ShardLimiter
 	}
 
-	return s.Close()
+	m.bucketsOnce.Do(func() {
+		interval := m.opts.ShardOptions.IdentifyInterval
+		if interval == 0 {
+			interval = identifyInterval
+		}
+
+		m.log(LogLevelDebug, "Using max concurrency %d, identifying every %s", g.SessionStartLimit.MaxConcurrency, interval)
+		m.buckets = NewBucketLimiter(g.SessionStartLimit.MaxConcurrency, interval)
+	})
+	return m.buckets.Bucket(id)
 }
 
-// FetchGateway fetches the gateway or from cache
-func (m *Manager) FetchGateway() (g *types.GatewayBot, err error) {
+// FetchGateway fetches the gateway or from cache. Failed fetches and gateways without a URL aren't
+// cached, so the next call fetches again.
+func (m *Manager) FetchGateway() (g *GatewayBot, err error) {
 	m.gatewayLock.Lock()
 	defer m.gatewayLock.Unlock()
 
-	if m.Gateway != nil {
-		g = m.Gateway
-	} else {
-		g, err = FetchGatewayBot(m.opts.REST)
-		m.log(LogLevelDebug, "Loaded gateway info %+v", g)
-		m.Gateway = g
+	if m.Gateway != nil && m.Gateway.URL != "" {
+		return m.Gateway, nil
 	}
+
+	g, err = FetchGatewayBot(m.opts.REST)
+	if err != nil {
+		return
+	}
+
+	m.log(LogLevelDebug, "Loaded gateway info %+v", g)
+	m.Gateway = g
 	return
 }
 
@@ -158,11 +254,13 @@ func (m *Manager) ConnectBroker(ctx context.Context, b broker.Broker, events map
 		}
 	}()
 
+	m.shardsMu.RLock()
 	eventList := make([]string, len(m.Shards)+1)
 	eventList = append(eventList, "SEND")
 	for id := range m.Shards {
 		eventList = append(eventList, strconv.FormatInt(int64(id), 10))
 	}
+	m.shardsMu.RUnlock()
 
 	go b.Subscribe(ctx, eventList, ch)
 }
@@ -188,7 +286,7 @@ func (m *Manager) handleMessage(ctx context.Context, b broker.Broker, msg broker
 		}
 
 		shardID := int(p.GuildID >> 22 % uint64(m.opts.ShardCount))
-		shard = m.Shards[shardID]
+		shard = m.Shard(shardID)
 		if shard == nil {
 			data, err := json.Marshal(p.Packet)
 			if err != nil {
@@ -208,7 +306,7 @@ func (m *Manager) handleMessage(ctx context.Context, b broker.Broker, msg broker
 		if err != nil {
 			m.log(LogLevelWarn, "received unexpected non-int event from AMQP: %s", err)
 		}
-		shard = m.Shards[shardID]
+		shard = m.Shard(shardID)
 		if shard == nil {
 			m.log(LogLevelWarn, "received event for shard %d which does not exist", shardID)
 			return
@@ -16,6 +16,10 @@ type ShardLimiter interface {
 type ManagerOptions struct {
 	ShardOptions *ShardOptions
 	REST         REST
+
+	// ShardLimiter, if set, gates the identifies of every shard. Otherwise, shards are gated by a
+	// BucketLimiter using the max_concurrency reported by Discord, allowing an identify per bucket
+	// every ShardOptions.IdentifyInterval, or slightly over 5 seconds if that's unset.
 	ShardLimiter Limiter
 
 	ShardCount  int
@@ -24,16 +28,25 @@ type ManagerOptions struct {
 
 	OnPacket func(int, *types.ReceivePacket)
 
-	Logger   *log.Logger
-	LogLevel int
+	// OnShardingRequired is called when Discord closes a shard because more shards are required.
+	// The shard isn't restarted, so the caller should start a manager with a new shard count.
+	OnShardingRequired func(shardID int)
+
+	// Events, if set, receives a copy of every packet received by every shard. Packets are sent
+	// synchronously, so the channel must be drained promptly.
+	Events chan<- ShardPacket
+
+	// LogHandler, if set, receives log messages instead of Logger
+	Logger     *log.Logger
+	LogHandler LogHandler
+	LogLevel   int
 }
 
-func (opts *ManagerOptions) init() {
-	if opts.ShardLimiter == nil {
-		// this is supposed to be 5s, but 5s causes every other session to be invalidated
-		opts.ShardLimiter = NewDefaultLimiter(1, 5250*time.Millisecond)
-	}
+// identifyInterval is the default interval between identifies in a bucket. This is supposed to be
+// 5s, but 5s causes every other session to be invalidated.
+const identifyInterval = 5250 * time.Millisecond
 
+func (opts *ManagerOptions) init() {
 	if opts.ServerCount == 0 {
 		opts.ServerCount = 1
 	}
@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/spec-tacles/gateway/gateway/gatewaytest"
+)
+
+// testREST answers GET /gateway/bot with each response in turn
+type testREST struct {
+	responses []interface{}
+}
+
+func (r *testREST) DoJSON(method, path string, body io.Reader, v interface{}) error {
+	res := r.responses[0]
+	r.responses = r.responses[1:]
+
+	if err, ok := res.(error); ok {
+		return err
+	}
+	d, _ := json.Marshal(res)
+	return json.Unmarshal(d, v)
+}
+
+func TestFetchGatewayRetriesFailures(t *testing.T) {
+	rest := &testREST{responses: []interface{}{
+		errors.New("unavailable"),
+		map[string]interface{}{"url": ""},
+		map[string]interface{}{"url": "wss://gateway.discord.gg", "shards": 2},
+	}}
+	m := NewManager(&ManagerOptions{REST: rest, LogLevel: LogLevelSuppress})
+
+	if _, err := m.FetchGateway(); err == nil {
+		t.Fatal("FetchGateway succeeded despite a failed request")
+	}
+	if g, err := m.FetchGateway(); err != nil || g.URL != "" {
+		t.Fatalf("got gateway %+v, %v, want an empty URL", g, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		g, err := m.FetchGateway()
+		if err != nil {
+			t.Fatalf("FetchGateway: %v", err)
+		}
+		if g.URL != "wss://gateway.discord.gg" || g.Shards != 2 {
+			t.Fatalf("got gateway %+v", g)
+		}
+	}
+}
+
+func TestShardLimiterUsesIdentifyInterval(t *testing.T) {
+	tests := []struct {
+		configured time.Duration
+		want       time.Duration
+	}{
+		{0, identifyInterval},
+		{time.Second, time.Second},
+	}
+
+	g := &GatewayBot{}
+	g.SessionStartLimit.MaxConcurrency = 2
+	for _, tt := range tests {
+		m := NewManager(&ManagerOptions{
+			ShardOptions: &ShardOptions{IdentifyInterval: tt.configured},
+			LogLevel:     LogLevelSuppress,
+		})
+
+		for id := 0; id < 2; id++ {
+			l := m.shardLimiter(g, id).(*DefaultLimiter)
+			if got := time.Duration(*l.duration); got != tt.want {
+				t.Errorf("configured %s: shard %d identifies every %s, want %s", tt.configured, id, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestClosedShardIsNotRestarted(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	rest := &testREST{responses: []interface{}{
+		map[string]interface{}{
+			"url":                 srv.URL(),
+			"shards":              1,
+			"session_start_limit": map[string]interface{}{"max_concurrency": 1},
+		},
+	}}
+	m := NewManager(&ManagerOptions{
+		ShardOptions: testOptions(&ShardOptions{}),
+		REST:         rest,
+		ShardCount:   1,
+		LogLevel:     LogLevelSuppress,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- m.Start(ctx) }()
+
+	waitFor(t, "shard to be ready", func() bool { return m.State(0) == ShardStateReady })
+	s := m.Shard(0)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("the manager kept supervising a closed shard")
+	}
+	if m.Shard(0) != s || srv.Connections() != 1 {
+		t.Fatalf("the closed shard was restarted: %d connections", srv.Connections())
+	}
+}
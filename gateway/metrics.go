@@ -0,0 +1,30 @@
+package gateway
+
+import (
+	"time"
+
+	"github.com/spec-tacles/go/types"
+)
+
+// Metrics receives counters from a shard. Byte sizes are of decompressed payloads.
+type Metrics interface {
+	PacketReceived(shard int, op types.GatewayOp, event types.GatewayEvent, size int)
+	PacketSent(shard int, op types.GatewayOp, size int)
+	HeartbeatSent(shard int)
+	HeartbeatAcked(shard int, latency time.Duration)
+	Reconnected(shard int)
+}
+
+// DisconnectMetrics is implemented by metrics that also count disconnects by their reason
+type DisconnectMetrics interface {
+	Disconnected(shard int, reason DisconnectReason)
+}
+
+// nopMetrics discards all metrics
+type nopMetrics struct{}
+
+func (nopMetrics) PacketReceived(int, types.GatewayOp, types.GatewayEvent, int) {}
+func (nopMetrics) PacketSent(int, types.GatewayOp, int)                         {}
+func (nopMetrics) HeartbeatSent(int)                                            {}
+func (nopMetrics) HeartbeatAcked(int, time.Duration)                            {}
+func (nopMetrics) Reconnected(int)                                              {}
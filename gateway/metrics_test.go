@@ -0,0 +1,60 @@
+package gateway
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/spec-tacles/gateway/gateway/gatewaytest"
+)
+
+// disconnectMetrics records the reason of every disconnect
+type disconnectMetrics struct {
+	nopMetrics
+
+	mu      sync.Mutex
+	reasons []DisconnectReason
+}
+
+func (m *disconnectMetrics) Disconnected(_ int, reason DisconnectReason) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reasons = append(m.reasons, reason)
+}
+
+func (m *disconnectMetrics) Reasons() []DisconnectReason {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]DisconnectReason(nil), m.reasons...)
+}
+
+func TestDisconnectMetrics(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	m := new(disconnectMetrics)
+	s := newTestShard(srv, &ShardOptions{Metrics: m})
+	openTestShard(t, s)
+
+	srv.Reconnect()
+	waitFor(t, "shard to resume", func() bool {
+		return srv.Resumes() == 1 && s.State() == ShardStateReady
+	})
+
+	if r := m.Reasons(); len(r) != 1 || r[0] != DisconnectReconnect {
+		t.Fatalf("got disconnect reasons %v, want [%s]", r, DisconnectReconnect)
+	}
+}
+
+func TestMetricsWithoutDisconnects(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	// metrics predating DisconnectMetrics still work
+	s := newTestShard(srv, &ShardOptions{Metrics: nopMetrics{}})
+	openTestShard(t, s)
+
+	srv.Reconnect()
+	waitFor(t, "shard to resume", func() bool {
+		return srv.Resumes() == 1 && s.State() == ShardStateReady
+	})
+}
@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/spec-tacles/go/types"
+)
+
+// OutputEncoder writes received packets to a stream. Encoders may be shared between shards, so
+// implementations must be safe for concurrent use.
+type OutputEncoder interface {
+	Encode(shard int, p *types.ReceivePacket) error
+}
+
+// outputPacket is a packet tagged with the shard that received it, so that a multiplexed stream
+// can be demultiplexed
+type outputPacket struct {
+	Shard int                `json:"shard"`
+	Op    types.GatewayOp    `json:"op"`
+	Data  json.RawMessage    `json:"d"`
+	Seq   types.Seq          `json:"s,omitempty"`
+	Event types.GatewayEvent `json:"t,omitempty"`
+}
+
+// LineEncoder writes each packet as a line of JSON
+type LineEncoder struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewLineEncoder creates an encoder that writes newline-delimited JSON to w
+func NewLineEncoder(w io.Writer) *LineEncoder {
+	return &LineEncoder{w: w}
+}
+
+// Encode writes the packet followed by a newline
+func (e *LineEncoder) Encode(shard int, p *types.ReceivePacket) error {
+	d, err := marshalOutput(shard, p)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err = e.w.Write(append(d, '\n'))
+	return err
+}
+
+// LengthPrefixEncoder writes each packet as JSON preceded by its length
+type LengthPrefixEncoder struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewLengthPrefixEncoder creates an encoder that writes JSON to w, prefixing each packet with its
+// length as a big-endian uint32
+func NewLengthPrefixEncoder(w io.Writer) *LengthPrefixEncoder {
+	return &LengthPrefixEncoder{w: w}
+}
+
+// Encode writes the length of the packet followed by the packet
+func (e *LengthPrefixEncoder) Encode(shard int, p *types.ReceivePacket) error {
+	d, err := marshalOutput(shard, p)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 4, len(d)+4)
+	binary.BigEndian.PutUint32(frame, uint32(len(d)))
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err = e.w.Write(append(frame, d...))
+	return err
+}
+
+func marshalOutput(shard int, p *types.ReceivePacket) ([]byte, error) {
+	return json.Marshal(&outputPacket{
+		Shard: shard,
+		Op:    p.Op,
+		Data:  p.Data,
+		Seq:   p.Seq,
+		Event: p.Event,
+	})
+}
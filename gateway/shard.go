@@ -3,84 +3,256 @@ package gateway
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
+	"net"
 	"net/url"
+	"runtime/debug"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/spec-tacles/gateway/compression"
 	"github.com/spec-tacles/gateway/stats"
 	"github.com/spec-tacles/go/types"
 )
 
+const (
+	// backoffResetAfter is how long a session must last for the reconnect backoff to reset
+	backoffResetAfter = time.Minute
+
+	// maxPooledPacketSize is the largest packet data whose buffer is kept for reuse
+	maxPooledPacketSize = 64 * 1024
+
+	// invalidSessionBackoff is the maximum wait before re-identifying after an invalid session
+	invalidSessionBackoff = 5 * time.Second
+
+	// heartbeatReserve is how many sends per SendInterval are reserved for automatic heartbeats
+	heartbeatReserve = 3
+)
+
 // Shard represents a Gateway shard
 type Shard struct {
-	Gateway *types.GatewayBot
+	Gateway *GatewayBot
 	Ping    time.Duration
 
 	conn *Connection
 
-	id            string
-	opts          *ShardOptions
-	limiter       Limiter
-	packets       *sync.Pool
-	lastHeartbeat time.Time
-
-	connMu sync.Mutex
-	acks   chan struct{}
+	id               string
+	opts             *ShardOptions
+	limiter          Limiter
+	heartbeatLimiter Limiter
+	packets          *sync.Pool
+	lastHeartbeat    int64
+	nextHeartbeat    int64
+	interval         int64
+	latency          int64
+	lastAck          int64
+	compressed       uint64
+	decompressed     uint64
+	reconnects       uint64
+	packetsReceived  uint64
+	packetsSent      uint64
+	bytesReceived    uint64
+	intents          uint64
+	highestSeq       uint64
+	resumeURL        atomic.Value
+	compression      atomic.Value
+	presence         atomic.Value
+	closeCause       atomic.Value
+	dispatchPool     atomic.Value
+	state            int32
+
+	guilds   map[string]struct{}
+	guildsMu sync.Mutex
+
+	standby   *standby
+	standbyMu sync.Mutex
+
+	// presenceLimiter paces coalesced presence updates, the latest of which is pendingPresence
+	presenceLimiter Limiter
+	presenceMu      sync.Mutex
+	pendingPresence *types.StatusUpdate
+	sendingPresence bool
+
+	// connMu guards writes to conn; closed rejects sends while there's no usable connection, and
+	// stopped, set by Close, stops Open from reconnecting by calling stop
+	connMu  sync.Mutex
+	closed  bool
+	stopped bool
+	stop    context.CancelFunc
+
+	// acks holds at most one pending ACK and is sent to without blocking, so a stray ACK can't
+	// stall the read loop while the heartbeater isn't receiving
+	acks       chan struct{}
+	heartbeats sync.WaitGroup
+
+	// heartbeatsSent and heartbeatsAcked count the heartbeats of the current connection, which
+	// Discord acknowledges in order, so that Heartbeat waits for the ACK of its own heartbeat.
+	// heartbeatMu serializes heartbeat writes so that they're counted in the order sent.
+	heartbeatMu     sync.Mutex
+	heartbeatsSent  uint64
+	heartbeatsAcked uint64
+	ackWaiters      []*ackWaiter
+	ackWaitersMu    sync.Mutex
+
+	ready       chan struct{}
+	readyMu     sync.Mutex
+	reconnectMu sync.Mutex
+
+	handlers   map[types.GatewayEvent][]EventHandler
+	handlersMu sync.RWMutex
+
+	allowEvents map[types.GatewayEvent]struct{}
+	denyEvents  map[types.GatewayEvent]struct{}
+
+	history     []*types.ReceivePacket
+	historyNext int
+	historyMu   sync.Mutex
+
+	// the pending handshake is only accessed by connect and the read loop it starts
+	handshake        atomic.Value
+	handshakeStart   time.Time
+	pendingHandshake Handshake
+
+	dispatchWaiters   map[*dispatchWaiter]struct{}
+	dispatchWaitersMu sync.Mutex
+
+	nonce            uint64
+	memberRequests   map[string]*memberRequest
+	memberRequestsMu sync.Mutex
 }
 
 // NewShard creates a new Gateway shard
 func NewShard(opts *ShardOptions) *Shard {
 	opts.init()
 
-	return &Shard{
-		opts:    opts,
-		limiter: NewDefaultLimiter(120, time.Minute),
+	s := &Shard{
+		opts:             opts,
+		limiter:          NewDefaultLimiter(opts.SendLimit-heartbeatReserve, opts.SendInterval),
+		heartbeatLimiter: NewDefaultLimiter(heartbeatReserve, opts.SendInterval),
 		packets: &sync.Pool{
 			New: func() interface{} {
 				return new(types.ReceivePacket)
 			},
 		},
-		id:   strconv.Itoa(opts.Identify.Shard[0]),
-		acks: make(chan struct{}),
+		acks:            make(chan struct{}, 1),
+		memberRequests:  make(map[string]*memberRequest),
+		handlers:        make(map[types.GatewayEvent][]EventHandler),
+		dispatchWaiters: make(map[*dispatchWaiter]struct{}),
+		guilds:          make(map[string]struct{}),
+		allowEvents:     eventSet(opts.AllowEvents),
+		denyEvents:      eventSet(opts.DenyEvents),
+		ready:           make(chan struct{}),
+		closed:          true,
+	}
+
+	// missing identifies are reported by Open
+	if opts.Identify != nil {
+		s.id = strconv.Itoa(opts.Identify.Shard[0])
+		s.intents = uint64(opts.Identify.Intents)
+	}
+	s.compression.Store(opts.Compression)
+	if opts.PresenceInterval > 0 {
+		s.presenceLimiter = NewDefaultLimiter(1, opts.PresenceInterval)
 	}
+	return s
 }
 
-// Open starts a new session. Any errors are fatal.
+// Open starts a new session, reconnecting until a fatal error unless DisableReconnect is set.
+// Unrecoverable closes are returned as a *CloseError. Cancelling the context closes the connection
+// with ShutdownCloseCode and returns ctx.Err(), keeping the store intact so that a resumable
+// session can be resumed later; Close instead invalidates the session and makes Open return nil.
 func (s *Shard) Open(ctx context.Context) (err error) {
-	err = s.connect(ctx)
-	for s.handleClose(err) {
+	if err = s.opts.validate(); err != nil {
+		return
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	s.connMu.Lock()
+	s.stopped, s.stop = false, stop
+	s.connMu.Unlock()
+
+	// stopping through Close isn't an error
+	defer func() {
+		if s.isStopped() {
+			err = nil
+		}
+	}()
+
+	defer s.setState(ShardStateClosed)
+	defer s.startDispatchWorkers()()
+
+	timeout := s.opts.Retryer.FirstTimeout()
+	retries := 0
+
+	for {
+		started := time.Now()
 		err = s.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// retrying can't help without usable gateway information
+		if errors.Is(err, ErrGatewayAbsent) || errors.Is(err, ErrInvalidGatewayURL) {
+			return
+		}
+
+		var handshakeErr *handshakeError
+		if errors.Is(err, ErrDecompressionFailed) || errors.As(err, &handshakeErr) {
+			s.downgradeCompression()
+		}
+
+		action := s.handleClose(ctx, err)
+		if action == CloseActionFatal || s.opts.DisableReconnect {
+			return newCloseError(err, action != CloseActionFatal)
+		}
+
+		// a long-lived session means the gateway is healthy again
+		if time.Since(started) > backoffResetAfter {
+			timeout = s.opts.Retryer.FirstTimeout()
+			retries = 0
+		}
+
+		s.setState(ShardStateReconnecting)
+		s.opts.Metrics.Reconnected(s.opts.Identify.Shard[0])
+		atomic.AddUint64(&s.reconnects, 1)
+
+		// the close has been handled, so only waiting can fail from here
+		err = nil
+		switch {
+		case action == CloseActionResumeNow:
+			s.log(LogLevelDebug, "reconnecting immediately")
+		case action != CloseActionBackoff && s.hasStandby():
+			s.log(LogLevelDebug, "reconnecting immediately using standby connection")
+		case action == CloseActionBackoff:
+			s.log(LogLevelDebug, "reconnecting in %s", s.opts.MaxBackoff)
+			err = s.wait(ctx, s.opts.MaxBackoff)
+		default:
+			s.log(LogLevelDebug, "reconnecting in up to %s", timeout)
+			err = s.backoff(ctx, timeout)
+		}
+		if err != nil {
+			return
+		}
+
+		retries++
+		if timeout, err = s.opts.Retryer.NextTimeout(timeout, retries); err != nil {
+			return
+		}
 	}
-	return
 }
 
 // connect runs a single websocket connection; errors may indicate the connection is recoverable
 func (s *Shard) connect(ctx context.Context) (err error) {
-	if s.Gateway == nil {
-		return ErrGatewayAbsent
-	}
-
-	url := s.gatewayURL()
-	s.log(LogLevelInfo, "Connecting using URL: %s", url)
-
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
-	if err != nil {
+	if err = s.checkGateway(); err != nil {
 		return
 	}
-	s.conn = NewConnection(conn, compression.NewZstd())
 
-	heartbeatCtx, cancelHeartbeat := context.WithCancel(ctx)
-	defer cancelHeartbeat()
-
-	err = s.expectPacket(ctx, types.GatewayOpHello, types.GatewayEventNone, s.handleHello(heartbeatCtx))
-	if err != nil {
-		return
-	}
+	s.setState(ShardStateConnecting)
 
 	seq, err := s.opts.Store.GetSeq(ctx, s.idUint())
 	if err != nil {
@@ -93,15 +265,95 @@ func (s *Shard) connect(ctx context.Context) (err error) {
 	}
 
 	s.log(LogLevelDebug, "session \"%s\", seq %d", sessionID, seq)
-	errs := make(chan error)
+	resuming := sessionID != ""
+	if resuming {
+		s.loadResumeURL(ctx)
+	}
+
+	// spread out resumes so that a fleet reconnecting at once doesn't resume in lockstep
+	if resuming {
+		if err = s.backoff(ctx, s.opts.ResumeJitter); err != nil {
+			return
+		}
+	}
+
+	url := s.gatewayURL(resuming)
+	s.beginHandshake()
+
+	var conn *Connection
+	sb := s.takeStandby(url)
+	if sb != nil {
+		s.log(LogLevelInfo, "Connecting using standby connection to URL: %s", url)
+		conn = sb.conn
+	} else {
+		s.log(LogLevelInfo, "Connecting using URL: %s", url)
+
+		ws, err := s.dial(ctx, url)
+		if errors.Is(err, websocket.ErrBadHandshake) {
+			return &handshakeError{err}
+		}
+		if err != nil {
+			return err
+		}
+		conn = NewConnection(ws, s.newCompressor())
+	}
+
+	s.pendingHandshake.Dial = time.Since(s.handshakeStart)
+	s.resetHeartbeats()
+	s.connMu.Lock()
+	if s.stopped {
+		s.connMu.Unlock()
+		conn.terminate()
+		return ErrShardClosed
+	}
+	s.conn = conn
+	conn.SetWriteTimeout(s.opts.WriteTimeout)
+	conn.SetReadTimeout(s.opts.ReadTimeout)
+	conn.SetReadLimit(s.opts.ReadLimit)
+	conn.SetPingInterval(s.opts.PingInterval)
+	conn.countCompression(&s.compressed, &s.decompressed)
+	s.closeCause.Store(closeCause{})
+	s.closed = false
+	s.connMu.Unlock()
+
+	// registered first so that it runs after terminate has unblocked any in-flight write
+	defer func() {
+		s.connMu.Lock()
+		s.closed = true
+		s.connMu.Unlock()
+	}()
+
+	// the heartbeater is stopped, then any write it's blocked on is aborted, before returning
+	defer s.heartbeats.Wait()
+	defer conn.terminate()
+
+	heartbeatCtx, cancelHeartbeat := context.WithCancel(ctx)
+	defer cancelHeartbeat()
+
+	hello := expect(types.GatewayOpHello, types.GatewayEventNone, s.handleHello(heartbeatCtx))
+	if sb != nil {
+		err = s.processPacket(ctx, sb.hello, hello)
+	} else {
+		err = s.readPacket(ctx, conn, hello)
+	}
+	if err != nil {
+		// connections closed by the shard itself weren't refused
+		if cause, _ := s.closeCause.Load().(closeCause); cause.err == nil && ctx.Err() == nil {
+			err = &handshakeError{err}
+		}
+		return
+	}
+
+	// buffered so that neither goroutine leaks once connect has returned
+	errs := make(chan error, 2)
 
 	go func() {
-		if sessionID == "" && seq == 0 {
-			if err = s.sendIdentify(); err != nil {
+		if !resuming {
+			if err := s.sendIdentify(); err != nil {
 				errs <- err
 			}
 		} else {
-			if err = s.sendResume(ctx); err != nil {
+			if err := s.sendResume(ctx); err != nil {
 				errs <- err
 			}
 		}
@@ -115,59 +367,374 @@ func (s *Shard) connect(ctx context.Context) (err error) {
 
 	go func() {
 		for {
-			err = s.readPacket(ctx, nil)
-			if err != nil {
+			if err := s.readPacket(ctx, conn, nil); err != nil {
 				errs <- err
-				break
+				return
 			}
 		}
 	}()
 
-	return <-errs
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		s.log(LogLevelInfo, "Context cancelled: closing connection")
+		s.CloseWithCode(s.opts.ShutdownCloseCode, "Shutting down")
+		err = ctx.Err()
+	}
+	return
 }
 
-// CloseWithReason closes the connection and logs the reason
+// CloseWithReason closes the connection and logs the reason. ErrShardClosed is returned if the
+// shard isn't connected.
 func (s *Shard) CloseWithReason(code int, reason error) error {
+	conn, err := s.openConn()
+	if err != nil {
+		return err
+	}
+
+	s.closeCause.Store(closeCause{err: reason})
 	s.log(LogLevelWarn, "%s: closing connection", reason)
-	return s.conn.CloseWithCode(code)
+	return conn.CloseWithCode(code)
+}
+
+// CloseWithCode sends a close frame with the given code and reason, waits briefly for Discord to
+// acknowledge it, then closes the underlying connection. Codes other than 1000 and 1001 keep the
+// session resumable. ErrShardClosed is returned if the shard isn't connected.
+func (s *Shard) CloseWithCode(code int, reason string) error {
+	conn, err := s.openConn()
+	if err != nil {
+		return err
+	}
+	return closeConn(conn, code, reason)
+}
+
+// openConn returns the current connection, or ErrShardClosed if there isn't one
+func (s *Shard) openConn() (*Connection, error) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	if s.closed {
+		return nil, ErrShardClosed
+	}
+	return s.conn, nil
 }
 
-// Close closes the current session
+// closeConn sends a close frame on the connection, closing it once the peer acknowledges the close
+// or closeTimeout passes
+func closeConn(conn *Connection, code int, reason string) (err error) {
+	err = conn.CloseWithReason(code, reason)
+
+	t := time.NewTimer(closeTimeout)
+	defer t.Stop()
+
+	select {
+	case <-conn.Done():
+	case <-t.C:
+		conn.terminate()
+	}
+	return
+}
+
+// Close closes the current session with a normal closure, invalidating it, and stops Open from
+// reconnecting. Any in-flight send completes first, and subsequent sends return ErrShardClosed.
 func (s *Shard) Close() (err error) {
-	if err = s.conn.Close(); err != nil {
-		return
+	s.connMu.Lock()
+	conn, open, stop := s.conn, !s.closed, s.stop
+	s.closed = true
+	s.stopped = true
+	s.connMu.Unlock()
+
+	if open {
+		err = closeConn(conn, websocket.CloseNormalClosure, "Normal Closure")
+	}
+	s.resetSession(context.Background())
+
+	// Open may be waiting to reconnect rather than reading
+	if stop != nil {
+		stop()
 	}
 
+	if err != nil {
+		return
+	}
 	s.log(LogLevelInfo, "Cleanly closed connection")
 	return
 }
 
-func (s *Shard) readPacket(ctx context.Context, fn func(*types.ReceivePacket) error) (err error) {
-	d, err := s.conn.Read()
+// isStopped reports whether Close has stopped the shard
+func (s *Shard) isStopped() bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	return s.stopped
+}
+
+// Reconnect closes the connection with a code that keeps the session resumable, then waits until
+// the shard has resumed or the context is done. If the shard is already reconnecting, it only
+// waits.
+func (s *Shard) Reconnect(ctx context.Context) (err error) {
+	s.reconnectMu.Lock()
+	switch s.State() {
+	case ShardStateClosed:
+		err = ErrShardClosed
+	case ShardStateReady:
+		// leave the ready state first so that waiting doesn't return before the new session
+		s.setState(ShardStateReconnecting)
+		err = s.CloseWithReason(types.CloseUnknownError, ErrReconnectRequested)
+	}
+	s.reconnectMu.Unlock()
+
 	if err != nil {
 		return
 	}
+	return s.WaitForReady(ctx)
+}
 
-	p := s.packets.Get().(*types.ReceivePacket)
-	defer s.packets.Put(p)
+// Intents returns the intents sent in each identify
+func (s *Shard) Intents() Intents {
+	return Intents(atomic.LoadUint64(&s.intents))
+}
+
+// SetIntents changes the intents sent in each identify. Since intents can't change during a
+// session, this invalidates the current session and, if the shard is connected, reconnects and
+// identifies with the new intents.
+func (s *Shard) SetIntents(i Intents) error {
+	if unknown := i.Remove(IntentsAll); unknown != 0 {
+		return fmt.Errorf("%w: unknown intents %d", ErrInvalidOptions, unknown)
+	}
 
-	err = json.Unmarshal(d, p)
+	atomic.StoreUint64(&s.intents, uint64(i))
+	return s.Invalidate()
+}
+
+// Invalidate ends the current session so that it can't be resumed. If the shard is connected, it
+// reconnects and identifies with a new session.
+func (s *Shard) Invalidate() error {
+	conn, err := s.openConn()
 	if err != nil {
+		s.resetSession(context.Background())
+		return nil
+	}
+
+	// the session is reset once the connection has ended, so that no dispatch still being read from
+	// it can store its sequence afterwards
+	s.closeCause.Store(closeCause{err: ErrReconnectRequested, invalidate: true})
+	return closeConn(conn, websocket.CloseNormalClosure, "Session invalidated")
+}
+
+// Compression returns the compression method in use, which differs from the configured method if
+// it failed and a fallback was used
+func (s *Shard) Compression() Compression {
+	return s.compression.Load().(Compression)
+}
+
+// downgradeCompression switches to the fallback of the current compression method, after it
+// failed to decompress or the gateway refused it. The shard reconnects either way.
+func (s *Shard) downgradeCompression() {
+	c := s.Compression()
+	if c == CompressionNone {
 		return
 	}
 
-	// remove event from any previous OP 0s that used this packet
-	if p.Op != types.GatewayOpDispatch {
-		p.Event = ""
+	s.log(LogLevelWarn, "Compression %s failed: falling back to %s", c, c.fallback())
+	s.compression.Store(c.fallback())
+}
+
+// RemoteAddr returns the address of the gateway server the shard is connected to, or nil if it
+// isn't connected
+func (s *Shard) RemoteAddr() net.Addr {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	return s.conn.RemoteAddr()
+}
+
+// LocalAddr returns the local address of the shard's connection, or nil if it isn't connected
+func (s *Shard) LocalAddr() net.Addr {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+// HeartbeatInterval returns the heartbeat interval of the current or most recent connection
+func (s *Shard) HeartbeatInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.interval))
+}
+
+// TimeUntilNextHeartbeat returns how long until the next automatic heartbeat is due, or zero if
+// the heartbeater isn't running
+func (s *Shard) TimeUntilNextHeartbeat() time.Duration {
+	next := atomic.LoadInt64(&s.nextHeartbeat)
+	if next == 0 {
+		return 0
+	}
+
+	if d := time.Until(time.Unix(0, next)); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Latency returns the round-trip time of the most recently acknowledged heartbeat
+func (s *Shard) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.latency))
+}
+
+// CompressionStats returns the totals of compressed messages received across every connection
+func (s *Shard) CompressionStats() CompressionStats {
+	return CompressionStats{
+		CompressedBytes:   atomic.LoadUint64(&s.compressed),
+		DecompressedBytes: atomic.LoadUint64(&s.decompressed),
+	}
+}
+
+// State returns the current state of the shard
+func (s *Shard) State() ShardState {
+	return ShardState(atomic.LoadInt32(&s.state))
+}
+
+// Ready returns a channel that's closed once the shard has processed READY or RESUMED. Once the
+// shard disconnects, subsequent calls return a new channel for the next session.
+func (s *Shard) Ready() <-chan struct{} {
+	s.readyMu.Lock()
+	defer s.readyMu.Unlock()
+
+	return s.ready
+}
+
+// WaitForReady blocks until the shard is ready or the context is done
+func (s *Shard) WaitForReady(ctx context.Context) error {
+	select {
+	case <-s.Ready():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SessionID returns the ID of the current or most recent session
+func (s *Shard) SessionID(ctx context.Context) (string, error) {
+	return s.opts.Store.GetSession(ctx, s.idUint())
+}
+
+// Sequence returns the sequence of the last dispatch received
+func (s *Shard) Sequence(ctx context.Context) (uint, error) {
+	return s.opts.Store.GetSeq(ctx, s.idUint())
+}
+
+// Restore seeds the shard store with a previous session so that the next connection resumes it
+func (s *Shard) Restore(ctx context.Context, sessionID string, seq uint) error {
+	if err := s.opts.Store.SetSession(ctx, s.idUint(), sessionID); err != nil {
+		return err
+	}
+
+	atomic.StoreUint64(&s.highestSeq, uint64(seq))
+	return s.opts.Store.SetSeq(ctx, s.idUint(), seq)
+}
+
+// SessionState is the state needed to resume a session, possibly from another process
+type SessionState struct {
+	SessionID string `json:"session_id"`
+	Seq       uint   `json:"seq"`
+	ResumeURL string `json:"resume_gateway_url,omitempty"`
+}
+
+// ExportState serializes the current session so that NewShardFromState can resume it. To hand the
+// session off, set ShutdownCloseCode to a code that keeps the session resumable, such as 4000, and
+// stop the shard by cancelling the context passed to Open. Close and the default shutdown code both
+// end the session.
+func (s *Shard) ExportState(ctx context.Context) ([]byte, error) {
+	sessionID, err := s.SessionID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seq, err := s.Sequence(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resumeURL, _ := s.resumeURL.Load().(string)
+	return json.Marshal(&SessionState{
+		SessionID: sessionID,
+		Seq:       seq,
+		ResumeURL: resumeURL,
+	})
+}
+
+// NewShardFromState creates a shard that resumes the session exported by ExportState when opened
+func NewShardFromState(ctx context.Context, opts *ShardOptions, state []byte) (*Shard, error) {
+	st := new(SessionState)
+	if err := json.Unmarshal(state, st); err != nil {
+		return nil, err
+	}
+
+	s := NewShard(opts)
+	if err := s.Restore(ctx, st.SessionID, st.Seq); err != nil {
+		return nil, err
+	}
+	s.resumeURL.Store(st.ResumeURL)
+	return s, nil
+}
+
+func (s *Shard) readPacket(ctx context.Context, conn *Connection, fn func(*types.ReceivePacket) error) (err error) {
+	d, err := conn.Read()
+	if err != nil {
+		return
+	}
+	return s.processPacket(ctx, d, fn)
+}
+
+// processPacket decodes and handles a message read from the connection
+func (s *Shard) processPacket(ctx context.Context, d []byte, fn func(*types.ReceivePacket) error) (err error) {
+	// packets are only recycled if callbacks promise not to retain them
+	p := s.packets.Get().(*types.ReceivePacket)
+	if s.opts.ReusePackets {
+		defer s.packets.Put(p)
+	}
+	resetPacket(p)
+
+	if err = s.opts.Encoding.Unmarshal(d, p); err != nil {
+		return newDecodeError(0, "", d, err)
+	}
+
+	if s.replayed(p) {
+		s.log(LogLevelDebug, "dropping replayed dispatch %d (%s)", p.Seq, p.Event)
+		return
+	}
+
+	// record the sequence before anything else so that heartbeats and resumes never lag behind
+	if p.Seq != 0 {
+		if err = s.opts.Store.SetSeq(ctx, s.idUint(), uint(p.Seq)); err != nil {
+			return
+		}
 	}
 
 	s.log(LogLevelDebug, "<- op:%d t:\"%s\"", p.Op, p.Event)
 
 	// record packet received
 	stats.PacketsReceived.WithLabelValues(string(p.Event), strconv.Itoa(int(p.Op)), s.id).Inc()
+	s.opts.Metrics.PacketReceived(s.opts.Identify.Shard[0], p.Op, p.Event, len(d))
+	atomic.AddUint64(&s.packetsReceived, 1)
+	atomic.AddUint64(&s.bytesReceived, uint64(len(d)))
 
-	if s.opts.OnPacket != nil {
-		s.opts.OnPacket(p)
+	if !s.filtered(p) {
+		s.recordPacket(p)
+
+		if !s.enqueueDispatch(p) {
+			s.runCallbacks(p)
+		}
+
+		if s.opts.Events != nil {
+			s.deliverEvent(ctx, p)
+		}
 	}
 
 	err = s.handlePacket(ctx, p)
@@ -181,9 +748,62 @@ func (s *Shard) readPacket(ctx context.Context, fn func(*types.ReceivePacket) er
 	return
 }
 
-// expectPacket reads the next packet, verifies its operation code, and event name (if applicable)
-func (s *Shard) expectPacket(ctx context.Context, op types.GatewayOp, event types.GatewayEvent, handler func(*types.ReceivePacket) error) (err error) {
-	err = s.readPacket(ctx, func(pk *types.ReceivePacket) error {
+// runCallbacks passes a packet to OnPacket, Output, and any event handlers
+func (s *Shard) runCallbacks(p *types.ReceivePacket) {
+	if s.opts.OnPacket != nil {
+		s.callHandler(p, func() { s.opts.OnPacket(p) })
+	}
+
+	if s.opts.Output != nil {
+		s.callHandler(p, func() {
+			if err := s.opts.Output.Encode(s.opts.Identify.Shard[0], p); err != nil {
+				s.log(LogLevelError, "Unable to write packet to output: %s", err)
+			}
+		})
+	}
+
+	if p.Op == types.GatewayOpDispatch {
+		s.dispatchEvent(p)
+	}
+}
+
+// callHandler calls fn, recovering from any panic so that a buggy handler can't kill the read loop
+func (s *Shard) callHandler(p *types.ReceivePacket, fn func()) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+
+		s.log(LogLevelError, "recovered from handler panic (op %d, event %q): %v\n%s", p.Op, p.Event, v, debug.Stack())
+		if s.opts.OnPanic != nil {
+			s.opts.OnPanic(s.opts.Identify.Shard[0], p, v)
+		}
+	}()
+
+	fn()
+}
+
+// replayed reports whether DropReplayedDispatches applies to the dispatch, recording its sequence
+// otherwise. READY starts a new session, so it's never dropped.
+func (s *Shard) replayed(p *types.ReceivePacket) bool {
+	if !s.opts.DropReplayedDispatches || p.Op != types.GatewayOpDispatch {
+		return false
+	}
+
+	seq := uint64(p.Seq)
+	if p.Event != types.GatewayEventReady && seq <= atomic.LoadUint64(&s.highestSeq) {
+		return true
+	}
+
+	atomic.StoreUint64(&s.highestSeq, seq)
+	return false
+}
+
+// expect returns a packet handler that verifies the operation code and event name (if applicable)
+// before calling handler
+func expect(op types.GatewayOp, event types.GatewayEvent, handler func(*types.ReceivePacket) error) func(*types.ReceivePacket) error {
+	return func(pk *types.ReceivePacket) error {
 		if pk.Op != op {
 			return fmt.Errorf("expected op to be %d, got %d", op, pk.Op)
 		}
@@ -197,9 +817,7 @@ func (s *Shard) expectPacket(ctx context.Context, op types.GatewayOp, event type
 		}
 
 		return nil
-	})
-
-	return
+	}
 }
 
 // handlePacket handles a packet according to its operation code
@@ -209,29 +827,34 @@ func (s *Shard) handlePacket(ctx context.Context, p *types.ReceivePacket) (err e
 		return s.handleDispatch(ctx, p)
 
 	case types.GatewayOpHeartbeat:
-		return s.sendHeartbeat(ctx)
+		return s.sendHeartbeat(ctx, false, nil)
 
 	case types.GatewayOpReconnect:
+		// a non-1000 close code keeps the session resumable, so the next connection resumes it
 		if err = s.CloseWithReason(types.CloseUnknownError, ErrReconnectReceived); err != nil {
 			return
 		}
+		return ErrReconnectReceived
 
 	case types.GatewayOpInvalidSession:
 		resumable := new(bool)
-		if err = json.Unmarshal(p.Data, resumable); err != nil {
+		if err = unmarshalData(p, resumable); err != nil {
 			return
 		}
 
+		// the current connection may be doomed, so resume on a new one as with a reconnect
 		if *resumable {
-			if err = s.sendResume(ctx); err != nil {
+			if err = s.CloseWithReason(types.CloseUnknownError, ErrSessionInvalidated); err != nil {
 				return
 			}
+			return ErrSessionInvalidated
+		}
 
-			s.log(LogLevelDebug, "Sent resume in response to invalid resumable session")
+		s.resetSession(ctx)
+		if err = s.backoff(ctx, invalidSessionBackoff); err != nil {
 			return
 		}
 
-		time.Sleep(time.Second * time.Duration(rand.Intn(5)+1))
 		if err = s.sendIdentify(); err != nil {
 			return
 		}
@@ -239,14 +862,35 @@ func (s *Shard) handlePacket(ctx context.Context, p *types.ReceivePacket) (err e
 		s.log(LogLevelDebug, "Sent identify in response to invalid non-resumable session")
 
 	case types.GatewayOpHeartbeatACK:
-		if s.lastHeartbeat.Unix() != 0 {
+		atomic.StoreInt64(&s.lastAck, time.Now().UnixNano())
+		if sent := atomic.LoadInt64(&s.lastHeartbeat); sent != 0 {
 			// record latest gateway ping
-			s.Ping = time.Since(s.lastHeartbeat)
+			s.Ping = time.Since(time.Unix(0, sent))
+			atomic.StoreInt64(&s.latency, int64(s.Ping))
+			s.opts.Metrics.HeartbeatAcked(s.opts.Identify.Shard[0], s.Ping)
 			stats.Ping.WithLabelValues(s.id).Observe(float64(s.Ping.Nanoseconds()) / 1e6)
 		}
 
-		s.log(LogLevelDebug, "Heartbeat ACK (RTT %s)", s.Ping)
-		s.acks <- struct{}{}
+		s.log(LogLevelDebug, "Heartbeat ACK (RTT %s)", s.Latency())
+
+		s.ackWaitersMu.Lock()
+		s.heartbeatsAcked++
+		waiting := s.ackWaiters[:0]
+		for _, w := range s.ackWaiters {
+			if w.n <= s.heartbeatsAcked {
+				w.rtt <- time.Since(w.sent)
+			} else {
+				waiting = append(waiting, w)
+			}
+		}
+		s.ackWaiters = waiting
+		s.ackWaitersMu.Unlock()
+
+		// the heartbeater may have already stopped, which mustn't block the read loop forever
+		select {
+		case s.acks <- struct{}{}:
+		default:
+		}
 	}
 
 	return
@@ -254,32 +898,61 @@ func (s *Shard) handlePacket(ctx context.Context, p *types.ReceivePacket) (err e
 
 // handleDispatch handles dispatch packets
 func (s *Shard) handleDispatch(ctx context.Context, p *types.ReceivePacket) (err error) {
-	if err = s.opts.Store.SetSeq(ctx, s.idUint(), uint(p.Seq)); err != nil {
-		return
+	// waiters see filtered dispatches too, so that SendAndWait can wait on events that are excluded
+	s.notifyDispatchWaiters(p)
+
+	if s.opts.TrackGuilds {
+		if err = s.trackGuilds(p); err != nil {
+			return
+		}
 	}
 
 	switch p.Event {
 	case types.GatewayEventReady:
-		r := new(types.Ready)
-		if err = json.Unmarshal(p.Data, r); err != nil {
+		r := new(Ready)
+		if err = unmarshalData(p, r); err != nil {
 			return
 		}
 
 		if err = s.opts.Store.SetSession(ctx, s.idUint(), r.SessionID); err != nil {
 			return
 		}
+		s.resumeURL.Store(r.ResumeGatewayURL)
+		if store, ok := s.opts.Store.(ResumeURLStore); ok {
+			if err = store.SetResumeURL(ctx, s.idUint(), r.ResumeGatewayURL); err != nil {
+				return
+			}
+		}
 
+		s.setState(ShardStateReady)
 		s.log(LogLevelDebug, "Session ID: %s", r.SessionID)
+		s.log(LogLevelDebug, "Resume URL: %s", r.ResumeGatewayURL)
 		s.log(LogLevelDebug, "Using version %d", r.Version)
 		s.logTrace(r.Trace)
+		s.completeHandshake(r.Trace)
 
 	case types.GatewayEventResumed:
 		r := new(types.Resumed)
-		if err = json.Unmarshal(p.Data, r); err != nil {
+		if err = unmarshalData(p, r); err != nil {
 			return
 		}
 
+		s.setState(ShardStateReady)
 		s.logTrace(r.Trace)
+		s.completeHandshake(r.Trace)
+
+		if p, ok := s.presence.Load().(*types.StatusUpdate); ok && s.opts.ReapplyPresence {
+			s.log(LogLevelDebug, "Reapplying presence after resume")
+			// sent separately so that waiting on the limiter doesn't stall the read loop
+			go func() {
+				if err := s.SendPacket(types.GatewayOpStatusUpdate, p); err != nil {
+					s.log(LogLevelError, "error reapplying presence: %s", err)
+				}
+			}()
+		}
+
+	case GatewayEventGuildMembersChunk:
+		return s.handleGuildMembersChunk(p)
 	}
 
 	return
@@ -288,32 +961,58 @@ func (s *Shard) handleDispatch(ctx context.Context, p *types.ReceivePacket) (err
 func (s *Shard) handleHello(ctx context.Context) func(*types.ReceivePacket) error {
 	return func(p *types.ReceivePacket) (err error) {
 		h := new(types.Hello)
-		if err = json.Unmarshal(p.Data, h); err != nil {
+		if err = unmarshalData(p, h); err != nil {
 			return
 		}
 
+		s.pendingHandshake.Hello = time.Since(s.handshakeStart)
+		s.pendingHandshake.Trace = h.Trace
 		s.logTrace(h.Trace)
-		go s.startHeartbeater(ctx, time.Duration(h.HeartbeatInterval)*time.Millisecond)
+		s.heartbeats.Add(1)
+		go func() {
+			defer s.heartbeats.Done()
+			s.startHeartbeater(ctx, time.Duration(h.HeartbeatInterval)*time.Millisecond)
+		}()
 		return
 	}
 }
 
-// handleClose handles the WebSocket close event. Returns whether the session is recoverable.
-func (s *Shard) handleClose(err error) (recoverable bool) {
-	recoverable = !websocket.IsCloseError(
-		err,
-		types.CloseAuthenticationFailed,
-		types.CloseInvalidShard,
-		types.CloseShardingRequired,
-		types.CloseInvalidAPIVersion,
-		types.CloseInvalidIntents,
-		types.CloseDisallowedIntents,
-	)
+// handleClose handles the WebSocket close event. Returns the action to take according to the close
+// policy.
+func (s *Shard) handleClose(ctx context.Context, err error) (action CloseAction) {
+	code, reason := 0, ""
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		code, reason = closeErr.Code, closeErr.Text
+	}
+
+	if s.opts.OnDisconnect != nil {
+		s.opts.OnDisconnect(s.opts.Identify.Shard[0], code, reason, err)
+	}
+
+	why := s.disconnectReason(code, err)
+	stats.Disconnects.WithLabelValues(why.String(), s.id).Inc()
+	if m, ok := s.opts.Metrics.(DisconnectMetrics); ok {
+		m.Disconnected(s.opts.Identify.Shard[0], why)
+	}
+
+	action = s.closeAction(code)
+	if cause, _ := s.closeCause.Load().(closeCause); cause.invalidate {
+		action = CloseActionReidentify
+	}
+	if s.opts.OnClose != nil {
+		action = s.opts.OnClose(s.opts.Identify.Shard[0], code, reason, action)
+	}
 
-	if recoverable {
-		s.log(LogLevelInfo, "recoverable close: %s", err)
+	// the session can't be resumed, so the next connection must identify
+	if action == CloseActionReidentify {
+		s.resetSession(ctx)
+	}
+
+	if action != CloseActionFatal {
+		s.log(LogLevelInfo, "recoverable close (%s, code %d, reason %q): %s", why, code, reason, err)
 	} else {
-		s.log(LogLevelInfo, "unrecoverable close: %s", err)
+		s.log(LogLevelInfo, "unrecoverable close (%s, code %d, reason %q): %s", why, code, reason, err)
 	}
 	return
 }
@@ -326,29 +1025,160 @@ func (s *Shard) SendPacket(op types.GatewayOp, data interface{}) error {
 	})
 }
 
-// Send sends a pre-prepared packet
+// Send sends a pre-prepared packet. ErrShardClosed is returned if the shard isn't connected.
 func (s *Shard) Send(p *types.SendPacket) error {
-	d, err := json.Marshal(p)
+	return s.send(p, s.limiter)
+}
+
+// SendRaw sends a packet that's already encoded with the shard's encoding, such as one being
+// relayed. The packet must be an object with an op; BeforeSend isn't called.
+func (s *Shard) SendRaw(d []byte) error {
+	var p struct {
+		Op types.GatewayOp `json:"op"`
+	}
+	if err := s.opts.Encoding.Unmarshal(d, &p); err != nil {
+		return fmt.Errorf("invalid raw packet: %w", err)
+	}
+
+	s.log(LogLevelDebug, "-> op:%d (raw)", p.Op)
+	return s.writeBytes(p.Op, d, s.limiter)
+}
+
+// send sends a packet once the limiter allows it; a nil limiter sends immediately
+func (s *Shard) send(p *types.SendPacket, limiter Limiter) error {
+	if s.opts.BeforeSend != nil {
+		proceed, err := s.opts.BeforeSend(p.Op, p.Data)
+		if err != nil || !proceed {
+			return err
+		}
+	}
+
+	s.log(LogLevelDebug, "-> op:%d d:%+v", p.Op, p.Data)
+
+	// JSON is encoded straight into the message
+	if s.opts.Encoding == EncodingJSON {
+		return s.write(p.Op, limiter, func() (int, error) {
+			return s.conn.WriteJSON(p)
+		})
+	}
+
+	d, err := s.opts.Encoding.Marshal(p)
 	if err != nil {
 		return err
 	}
+	return s.writeBytes(p.Op, d, limiter)
+}
+
+// writeBytes writes an encoded packet once the limiter allows it
+func (s *Shard) writeBytes(op types.GatewayOp, d []byte, limiter Limiter) error {
+	return s.write(op, limiter, func() (int, error) {
+		return s.conn.Write(d)
+	})
+}
+
+// write calls fn to write a packet once the limiter allows it
+func (s *Shard) write(op types.GatewayOp, limiter Limiter, fn func() (int, error)) (err error) {
+	if limiter != nil {
+		limiter.Lock()
+	}
 
-	s.limiter.Lock()
 	s.connMu.Lock()
 	defer s.connMu.Unlock()
 
+	if s.closed {
+		return ErrShardClosed
+	}
+
+	n, err := fn()
+	if err != nil {
+		return
+	}
+
 	// record packet sent
-	defer stats.PacketsSent.WithLabelValues("", strconv.Itoa(int(p.Op)), s.id).Inc()
+	stats.PacketsSent.WithLabelValues("", strconv.Itoa(int(op)), s.id).Inc()
+	s.opts.Metrics.PacketSent(s.opts.Identify.Shard[0], op, n)
+	atomic.AddUint64(&s.packetsSent, 1)
+	return
+}
 
-	s.log(LogLevelDebug, "-> op:%d d:%+v", p.Op, p.Data)
-	_, err = s.conn.Write(d)
-	return err
+// UpdatePresence sends a presence update. The presence is remembered as the shard's latest
+// presence.
+func (s *Shard) UpdatePresence(p *types.StatusUpdate) error {
+	switch types.PresenceStatus(p.Status) {
+	case types.PresenceStatusOnline, types.PresenceStatusIdle, types.PresenceStatusDND,
+		types.PresenceStatusInvisible, types.PresenceStatusOffline:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidStatus, p.Status)
+	}
+
+	s.presence.Store(p)
+	if s.presenceLimiter == nil {
+		return s.SendPacket(types.GatewayOpStatusUpdate, p)
+	}
+
+	s.presenceMu.Lock()
+	s.pendingPresence = p
+	if s.sendingPresence {
+		s.presenceMu.Unlock()
+		return nil
+	}
+	s.sendingPresence = true
+	s.presenceMu.Unlock()
+
+	return s.flushPresence()
+}
+
+// flushPresence sends pending presence updates, one per PresenceInterval, until none are left
+func (s *Shard) flushPresence() error {
+	for {
+		s.presenceMu.Lock()
+		if s.pendingPresence == nil {
+			s.sendingPresence = false
+			s.presenceMu.Unlock()
+			return nil
+		}
+		s.presenceMu.Unlock()
+
+		// updates made while waiting replace the pending one
+		s.presenceLimiter.Lock()
+
+		s.presenceMu.Lock()
+		p := s.pendingPresence
+		s.pendingPresence = nil
+		s.presenceMu.Unlock()
+
+		if err := s.SendPacket(types.GatewayOpStatusUpdate, p); err != nil {
+			s.presenceMu.Lock()
+			s.sendingPresence = false
+			s.presenceMu.Unlock()
+			return err
+		}
+	}
+}
+
+// UpdateVoiceState joins, moves between, or leaves (with a nil channelID) voice channels
+func (s *Shard) UpdateVoiceState(guildID string, channelID *string, selfMute, selfDeaf bool) error {
+	return s.SendPacket(types.GatewayOpVoiceStateUpdate, &VoiceStateUpdate{
+		GuildID:   guildID,
+		ChannelID: channelID,
+		SelfMute:  selfMute,
+		SelfDeaf:  selfDeaf,
+	})
 }
 
 // sendIdentify sends an identify packet
 func (s *Shard) sendIdentify() error {
+	s.setState(ShardStateIdentifying)
 	s.opts.IdentifyLimiter.Lock()
-	return s.SendPacket(types.GatewayOpIdentify, s.opts.Identify)
+
+	identify := *s.opts.Identify
+	identify.Intents = int(s.Intents())
+	identify.Compress = s.payloadCompression()
+	if p, ok := s.presence.Load().(*types.StatusUpdate); ok && s.opts.ReapplyPresence {
+		identify.Presence = p
+	}
+
+	return s.SendPacket(types.GatewayOpIdentify, &identify)
 }
 
 // sendResume sends a resume packet
@@ -358,11 +1188,17 @@ func (s *Shard) sendResume(ctx context.Context) error {
 		return err
 	}
 
+	// the session may have been invalidated while connecting
+	if sessionID == "" {
+		return s.sendIdentify()
+	}
+
 	seq, err := s.opts.Store.GetSeq(ctx, s.idUint())
 	if err != nil {
 		return err
 	}
 
+	s.setState(ShardStateResuming)
 	s.log(LogLevelDebug, "attempting to resume session")
 	return s.SendPacket(types.GatewayOpResume, &types.Resume{
 		Token:     s.opts.Identify.Token,
@@ -371,42 +1207,187 @@ func (s *Shard) sendResume(ctx context.Context) error {
 	})
 }
 
-// sendHeartbeat sends a heartbeat packet
-func (s *Shard) sendHeartbeat(ctx context.Context) error {
+// ackWaiter is a pending Heartbeat awaiting the ACK of the nth heartbeat of the connection
+type ackWaiter struct {
+	n    uint64
+	sent time.Time
+	rtt  chan time.Duration
+}
+
+// Heartbeat sends a heartbeat and waits for it to be acknowledged, returning the round-trip time.
+// ACKs of earlier heartbeats, including automatic ones, aren't mistaken for its own. Automatic
+// heartbeats are unaffected. ErrConnectionClosed is returned if the connection ends first.
+func (s *Shard) Heartbeat(ctx context.Context) (time.Duration, error) {
+	// buffered so that an abandoned wait doesn't block packet handling
+	w := &ackWaiter{rtt: make(chan time.Duration, 1)}
+	if err := s.sendHeartbeat(ctx, false, w); err != nil {
+		return 0, err
+	}
+
+	select {
+	case rtt, ok := <-w.rtt:
+		if !ok {
+			return 0, ErrConnectionClosed
+		}
+		return rtt, nil
+	case <-ctx.Done():
+		s.removeAckWaiter(w)
+		return 0, ctx.Err()
+	}
+}
+
+// sendHeartbeat sends a heartbeat packet, registering w, if set, to wait for its ACK. Priority
+// heartbeats are limited by the sends reserved for automatic heartbeats, rather than competing with
+// other sends, since a late automatic heartbeat gets the connection closed as a zombie.
+func (s *Shard) sendHeartbeat(ctx context.Context, priority bool, w *ackWaiter) error {
+	limiter := s.limiter
+	if priority {
+		limiter = s.heartbeatLimiter
+	}
+
+	// waited for here so that waiting can be stopped, and doesn't hold up other heartbeats
+	if err := lockContext(ctx, limiter); err != nil {
+		return err
+	}
+
 	seq, err := s.opts.Store.GetSeq(ctx, s.idUint())
 	if err != nil {
 		return err
 	}
 
-	s.lastHeartbeat = time.Now()
-	return s.SendPacket(types.GatewayOpHeartbeat, seq)
+	s.heartbeatMu.Lock()
+	defer s.heartbeatMu.Unlock()
+
+	sent := time.Now()
+	atomic.StoreInt64(&s.lastHeartbeat, sent.UnixNano())
+	s.opts.Metrics.HeartbeatSent(s.opts.Identify.Shard[0])
+
+	// registered before sending so that a fast ACK can't be missed
+	if w != nil {
+		w.n, w.sent = s.heartbeatsSent+1, sent
+		s.ackWaitersMu.Lock()
+		s.ackWaiters = append(s.ackWaiters, w)
+		s.ackWaitersMu.Unlock()
+	}
+
+	// Discord expects null until a dispatch has been received
+	p := &types.SendPacket{Op: types.GatewayOpHeartbeat}
+	if seq != 0 {
+		p.Data = seq
+	}
+	if err = s.send(p, nil); err != nil {
+		if w != nil {
+			s.removeAckWaiter(w)
+		}
+		return err
+	}
+
+	s.heartbeatsSent++
+	return nil
 }
 
-// startHeartbeater calls sendHeartbeat on the provided interval
+// removeAckWaiter stops waiting for an ACK, if it hasn't already arrived
+func (s *Shard) removeAckWaiter(w *ackWaiter) {
+	s.ackWaitersMu.Lock()
+	defer s.ackWaitersMu.Unlock()
+
+	for i, o := range s.ackWaiters {
+		if o == w {
+			s.ackWaiters = append(s.ackWaiters[:i], s.ackWaiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// resetHeartbeats starts counting heartbeats again for a new connection. Heartbeats of the previous
+// connection never get an ACK, so anything still waiting for one is told the connection closed.
+func (s *Shard) resetHeartbeats() {
+	s.heartbeatMu.Lock()
+	defer s.heartbeatMu.Unlock()
+	s.ackWaitersMu.Lock()
+	defer s.ackWaitersMu.Unlock()
+
+	s.heartbeatsSent, s.heartbeatsAcked = 0, 0
+	for _, w := range s.ackWaiters {
+		close(w.rtt)
+	}
+	s.ackWaiters = nil
+}
+
+// startHeartbeater calls sendHeartbeat on the provided interval. The first heartbeat is sent after
+// a jittered fraction of the interval so that many shards don't heartbeat in lockstep.
 func (s *Shard) startHeartbeater(ctx context.Context, interval time.Duration) {
-	t := time.NewTicker(interval)
+	atomic.StoreInt64(&s.interval, int64(interval))
+	defer atomic.StoreInt64(&s.nextHeartbeat, 0)
+
+	first := time.Duration(float64(interval) * s.opts.HeartbeatJitter())
+	atomic.StoreInt64(&s.nextHeartbeat, time.Now().Add(first).UnixNano())
+	t := time.NewTimer(first)
 	defer t.Stop()
 
+	// schedule resets the timer, recording the deadline for TimeUntilNextHeartbeat
+	schedule := func(d time.Duration) {
+		atomic.StoreInt64(&s.nextHeartbeat, time.Now().Add(d).UnixNano())
+		t.Reset(d)
+	}
+
+	// discard any ACK left over from the previous connection
+	select {
+	case <-s.acks:
+	default:
+	}
+
 	acked := true
 	s.log(LogLevelInfo, "starting heartbeat at interval %s", interval)
 	defer s.log(LogLevelDebug, "stopping heartbeat timer")
 
+	// fires if an ACK takes longer than HeartbeatTimeout to arrive
+	var zombie <-chan time.Time
+
+	// missed counts consecutive unacknowledged heartbeats; graced is whether the current one has
+	// already been given HeartbeatTimeoutGrace
+	missed, graced := 0, false
+
 	for {
 		select {
 		case <-s.acks:
 			acked = true
+			missed = 0
+			zombie = nil
+		case <-zombie:
+			// not 4009, which would be echoed back and stop the session from being resumed
+			s.CloseWithReason(types.CloseUnknownError, ErrHeartbeatUnacknowledged)
+			return
 		case <-t.C:
 			if !acked {
-				s.CloseWithReason(types.CloseSessionTimeout, ErrHeartbeatUnacknowledged)
-				return
+				if s.opts.HeartbeatTimeoutGrace > 0 && !graced {
+					graced = true
+					schedule(s.opts.HeartbeatTimeoutGrace)
+					continue
+				}
+
+				missed++
+				s.log(LogLevelWarn, "heartbeat unacknowledged (%d of %d allowed)", missed, s.opts.MaxMissedHeartbeats)
+				if missed >= s.opts.MaxMissedHeartbeats {
+					s.CloseWithReason(types.CloseUnknownError, ErrHeartbeatUnacknowledged)
+					return
+				}
 			}
+			graced = false
 
 			s.log(LogLevelDebug, "sending automatic heartbeat")
-			if err := s.sendHeartbeat(ctx); err != nil {
-				s.log(LogLevelError, "error sending automatic heartbeat: %s", err)
+			if err := s.sendHeartbeat(ctx, true, nil); err != nil {
+				if ctx.Err() == nil {
+					s.log(LogLevelError, "error sending automatic heartbeat: %s", err)
+				}
 				return
 			}
 			acked = false
+			schedule(interval)
+
+			if s.opts.HeartbeatTimeout > 0 {
+				zombie = time.After(s.opts.HeartbeatTimeout)
+			}
 
 		case <-ctx.Done():
 			return
@@ -414,15 +1395,155 @@ func (s *Shard) startHeartbeater(ctx context.Context, interval time.Duration) {
 	}
 }
 
-// gatewayURL returns the Gateway URL with appropriate query parameters
-func (s *Shard) gatewayURL() string {
+// GatewayURL returns the URL the next connection would use, which is the resume URL if there's a
+// session to resume
+func (s *Shard) GatewayURL(ctx context.Context) (string, error) {
+	if err := s.checkGateway(); err != nil {
+		return "", err
+	}
+
+	sessionID, err := s.SessionID(ctx)
+	if err != nil {
+		return "", err
+	}
+	return s.gatewayURL(sessionID != ""), nil
+}
+
+// checkGateway checks that gateway information has been fetched and has a websocket URL
+func (s *Shard) checkGateway() error {
+	if s.Gateway == nil {
+		return ErrGatewayAbsent
+	}
+
+	u, err := url.Parse(s.Gateway.URL)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidGatewayURL, err)
+	}
+
+	if (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return fmt.Errorf("%w: %q must be a ws or wss URL", ErrInvalidGatewayURL, s.Gateway.URL)
+	}
+	return nil
+}
+
+// gatewayURL returns the Gateway URL with appropriate query parameters. Resumes target the resume
+// URL received in READY, if any.
+func (s *Shard) gatewayURL(resuming bool) string {
 	query := url.Values{
 		"v":        {strconv.FormatUint(uint64(s.opts.Version), 10)},
-		"encoding": {"json"},
-		"compress": {"zstd-stream"},
+		"encoding": {string(s.opts.Encoding)},
+	}
+
+	if c := s.Compression(); c != CompressionNone {
+		query.Set("compress", string(c))
+	}
+
+	base := s.Gateway.URL
+	if resumeURL, _ := s.resumeURL.Load().(string); resuming && resumeURL != "" {
+		base = resumeURL
+	}
+
+	return base + "/?" + query.Encode()
+}
+
+// loadResumeURL loads the resume URL from the store if the session was persisted elsewhere
+func (s *Shard) loadResumeURL(ctx context.Context) {
+	store, ok := s.opts.Store.(ResumeURLStore)
+	if resumeURL, _ := s.resumeURL.Load().(string); !ok || resumeURL != "" {
+		return
+	}
+
+	resumeURL, err := store.GetResumeURL(ctx, s.idUint())
+	if err != nil {
+		s.log(LogLevelWarn, "Unable to retrieve resume URL: %s", err)
+		return
+	}
+	s.resumeURL.Store(resumeURL)
+}
+
+// resetSession forgets the current session so that the next connection identifies
+func (s *Shard) resetSession(ctx context.Context) {
+	s.resumeURL.Store("")
+	atomic.StoreUint64(&s.highestSeq, 0)
+	if err := resetStoredSession(ctx, s.opts.Store, s.idUint()); err != nil {
+		s.log(LogLevelWarn, "Unable to reset session: %s", err)
+	}
+}
+
+// setState transitions the shard to the given state, notifying OnStateChange of any change
+func (s *Shard) setState(state ShardState) {
+	s.readyMu.Lock()
+	prev := ShardState(atomic.SwapInt32(&s.state, int32(state)))
+	if prev == state {
+		s.readyMu.Unlock()
+		return
 	}
 
-	return s.Gateway.URL + "/?" + query.Encode()
+	if state == ShardStateReady {
+		close(s.ready)
+	} else if prev == ShardStateReady {
+		s.ready = make(chan struct{})
+	}
+	s.readyMu.Unlock()
+
+	if s.opts.OnStateChange != nil {
+		s.opts.OnStateChange(s.opts.Identify.Shard[0], state)
+	}
+}
+
+// backoff waits for a random duration of up to max, returning early if the context is cancelled
+func (s *Shard) backoff(ctx context.Context, max time.Duration) error {
+	if max <= 0 {
+		return nil
+	}
+
+	return s.wait(ctx, time.Duration(s.opts.Rand()*float64(max)))
+}
+
+// wait waits for the duration, returning early if the context is cancelled
+func (s *Shard) wait(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retainPacket returns a packet that's safe to retain after readPacket returns
+func (s *Shard) retainPacket(p *types.ReceivePacket) *types.ReceivePacket {
+	if s.opts.ReusePackets {
+		return clonePacket(p)
+	}
+	return p
+}
+
+// resetPacket clears a pooled packet, keeping its data buffer for reuse unless it's grown large
+func resetPacket(p *types.ReceivePacket) {
+	data := p.Data[:0]
+	if cap(data) > maxPooledPacketSize {
+		data = nil
+	}
+
+	*p = types.ReceivePacket{Data: data}
+}
+
+// unmarshalData decodes the data of a packet, describing the packet if it fails
+func unmarshalData(p *types.ReceivePacket, v interface{}) error {
+	if err := json.Unmarshal(p.Data, v); err != nil {
+		return newDecodeError(p.Op, p.Event, p.Data, err)
+	}
+	return nil
+}
+
+// clonePacket copies a packet so that it can outlive the packet pool
+func clonePacket(p *types.ReceivePacket) *types.ReceivePacket {
+	c := *p
+	c.Data = append([]byte(nil), p.Data...)
+	return &c
 }
 
 func (s *Shard) idUint() uint {
@@ -1,11 +1,19 @@
 package gateway
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"runtime"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/spec-tacles/gateway/compression"
 	"github.com/spec-tacles/go/types"
 )
 
@@ -17,45 +25,355 @@ type Retryer interface {
 
 // ShardOptions represents NewShard's options
 type ShardOptions struct {
-	Identify *types.Identify
-	Version  uint
-	Retryer  Retryer
-	Store    ShardStore
+	Identify    *types.Identify
+	Version     uint
+	Compression Compression
+	Encoding    Encoding
+	Store       ShardStore
+
+	// ShardID and ShardCount set the shard sent in Identify if it doesn't specify one. Without
+	// either, the shard identifies as [0, 1].
+	ShardID    int
+	ShardCount int
+
+	// PayloadCompression sets compress in Identify, so that Discord zlib-compresses large payloads
+	// individually. Discord doesn't allow both kinds of compression, so it's only used while
+	// Compression is CompressionNone, including after falling back to it.
+	PayloadCompression bool
+
+	// CompressionOptions tunes the buffers used by each connection's compression context
+	CompressionOptions compression.Options
+
+	// Dialer is used to establish websocket connections, allowing proxies, TLS configuration, and
+	// handshake timeouts to be customized. Defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+
+	// Proxy, if set, connects through an HTTP (using CONNECT) or SOCKS5 proxy, authenticating with
+	// any credentials in the URL. It takes precedence over the proxy of a custom Dialer.
+	Proxy *url.URL
+
+	// TLSConfig, if set, is used for TLS connections instead of the TLS configuration of Dialer,
+	// such as to pin certificates with VerifyPeerCertificate. Pinning a leaf certificate breaks
+	// connections whenever Discord rotates it, so prefer pinning a CA.
+	TLSConfig *tls.Config
+
+	// RequestHeader is sent with the websocket handshake. A User-Agent identifying Library is
+	// added unless one is set.
+	RequestHeader http.Header
+
+	// Library identifies the client to Discord as "name/version", in the User-Agent and as the
+	// default browser and device properties. Defaults to DefaultLibrary.
+	Library string
+
+	// SendLimit is how many packets may be sent per SendInterval, defaulting to Discord's limit of
+	// 120 per minute. A few of these are reserved for automatic heartbeats.
+	SendLimit    int32
+	SendInterval time.Duration
+
+	// Properties, if set, overrides the properties sent in Identify. Any blank properties default
+	// to the OS and Library.
+	Properties *types.IdentifyProperties
+
+	// Intents, if set, overrides the intents sent in Identify
+	Intents Intents
+
+	// ReapplyPresence sends the latest presence from UpdatePresence when identifying and after
+	// resuming, so that it survives reconnects
+	ReapplyPresence bool
+
+	// PresenceInterval, if set, sends presence updates at most once per interval. Updates made
+	// while another is waiting replace it, so only the latest is sent; UpdatePresence returns nil
+	// for these without waiting.
+	PresenceInterval time.Duration
+
+	// Retryer determines the maximum wait between reconnect attempts; the actual wait is randomly
+	// jittered. If unset, the timeout starts at InitialBackoff and grows by BackoffFactor up to
+	// MaxBackoff.
+	Retryer        Retryer
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	BackoffFactor  float64
+
+	// DisableReconnect makes Open return once the first connection ends, instead of reconnecting.
+	// Closes are returned as a *CloseError whose Recoverable field reports whether a reconnect
+	// could have resumed or re-identified.
+	DisableReconnect bool
+
+	// ShutdownCloseCode is the close code sent when the context passed to Open is cancelled. It
+	// defaults to 1000, which makes Discord end the session immediately. Handing the session off
+	// with ExportState instead needs a code that keeps it resumable, such as 4000.
+	ShutdownCloseCode int
+
+	// ClosePolicy overrides the action taken when the connection closes with a given code. Codes
+	// not in ClosePolicy use DefaultClosePolicy.
+	ClosePolicy map[int]CloseAction
+
+	// OnClose, if set, is called with the shard ID, close code and reason whenever a connection
+	// ends, along with the action ClosePolicy decided on. The returned action is taken instead,
+	// such as to stop on a specific reason.
+	OnClose func(shard int, code int, reason string, action CloseAction) CloseAction
+
+	// ResumeJitter is the maximum random wait before connecting to resume a session
+	ResumeJitter time.Duration
 
 	OnPacket func(*types.ReceivePacket)
 
-	Logger   *log.Logger
-	LogLevel int
+	// DispatchWorkers, if set, runs OnPacket, Output, and event handlers for dispatches on this
+	// many goroutines, so that slow callbacks don't delay heartbeats or reading. A single worker
+	// handles dispatches in order; with more, dispatches may be handled concurrently and out of
+	// order. Other packets are still handled by the read loop, so their callbacks may run before
+	// those of earlier dispatches.
+	DispatchWorkers int
+
+	// OnPanic, if set, is called with the shard ID, packet and recovered value when OnPacket, Output
+	// or an event handler panics. Such panics are always recovered and logged so the shard keeps
+	// running.
+	OnPanic func(shard int, p *types.ReceivePacket, v interface{})
+
+	// BeforeSend, if set, is called before every packet is sent. Returning false silently drops the
+	// packet, and returning an error aborts the send with that error. Dropping heartbeats gets the
+	// connection closed.
+	BeforeSend func(op types.GatewayOp, data interface{}) (proceed bool, err error)
+
+	// ReusePackets recycles packets once OnPacket returns, reducing allocations. When enabled,
+	// OnPacket must not retain packets or their data.
+	ReusePackets bool
+
+	// Events, if set, asynchronously receives a copy of every packet. The channel's capacity is
+	// its buffer size, and EventsPolicy determines what happens when it's full.
+	Events       chan *types.ReceivePacket
+	EventsPolicy BackpressurePolicy
+
+	// AllowEvents, if set, lists the only dispatches delivered to callbacks, Events, Output, and
+	// handlers, while DenyEvents lists dispatches that aren't delivered. Filtered dispatches still
+	// advance the sequence, are handled internally, and resolve SendAndWait.
+	AllowEvents []types.GatewayEvent
+	DenyEvents  []types.GatewayEvent
+
+	// TrackGuilds maintains GuildCount from READY, GUILD_CREATE, and GUILD_DELETE, at the cost of
+	// decoding the IDs of those dispatches
+	TrackGuilds bool
+
+	// DropReplayedDispatches discards any dispatch, other than READY, whose sequence isn't above
+	// the highest already processed in the session, so events replayed by a resume are never
+	// handled twice
+	DropReplayedDispatches bool
+
+	// PacketHistory is how many of the most recently received packets RecentPackets returns. Zero
+	// disables the history.
+	PacketHistory int
+
+	// Output, if set, writes every packet to a stream with framing and the shard ID
+	Output OutputEncoder
+
+	// OnStateChange is called whenever the shard transitions between states
+	OnStateChange func(shard int, state ShardState)
+	// OnHandshake is called with the handshake timing and trace whenever a session becomes ready
+	OnHandshake func(shard int, h Handshake)
+	// OnDisconnect is called whenever a connection ends, with the close code and reason if a close
+	// frame was received. Unrecoverable closes are also returned from Open as a *CloseError.
+	OnDisconnect func(shard int, code int, reason string, err error)
+
+	// TraceHandler, if set, receives the gateway servers traced in HELLO, READY, and RESUMED
+	// instead of them being logged
+	TraceHandler func(shard int, trace []string)
+
+	// LogHandler, if set, receives log messages instead of Logger
+	Logger     *log.Logger
+	LogHandler LogHandler
+	LogLevel   int
 
-	IdentifyLimiter Limiter
+	// Metrics, if set, receives packet, heartbeat, and reconnect counters
+	Metrics Metrics
+
+	// IdentifyLimiter gates identify packets. Shards in the same rate limit bucket must share a
+	// limiter, such as BucketLimiter.Bucket(shardID) from a BucketLimiter shared by every shard; if
+	// unset, a limiter allowing one identify every IdentifyInterval is created for this shard.
+	IdentifyLimiter  Limiter
+	IdentifyInterval time.Duration
+
+	// WriteTimeout limits how long a single write may block before the connection is closed and
+	// reconnected. Zero disables the limit.
+	WriteTimeout time.Duration
+
+	// WriteCoalesceWindow, if set, holds writes back for up to this long so that packets sent in a
+	// burst reach the network in a single write. Discord requires every packet in its own websocket
+	// message, so messages aren't merged, only the writes carrying them. Every packet, including
+	// heartbeats, may be delayed by up to the window in exchange for fewer syscalls and TCP segments
+	// under load; sends are still rate limited. Zero, the default, writes each message immediately.
+	WriteCoalesceWindow time.Duration
+
+	// ReadTimeout limits how long to wait for each packet before the connection is considered
+	// dead and reconnected. Since every heartbeat is acknowledged, a value slightly larger than the
+	// heartbeat interval detects dead sockets without affecting healthy ones. Zero disables it.
+	ReadTimeout time.Duration
+
+	// PingInterval sends a websocket ping at this interval, reconnecting if the pong doesn't
+	// arrive before the next ping. This detects dead peers sooner than a long heartbeat
+	// interval, but must be longer than any handler may block the read loop. Zero disables it.
+	PingInterval time.Duration
+
+	// ReadLimit is the maximum size in bytes of a message, as received before decompression.
+	// Larger messages close the connection. Zero, the default, allows messages of any size, since
+	// guild member chunks for large guilds can be very large.
+	ReadLimit int64
+
+	// HeartbeatTimeout closes the connection as a zombie if a heartbeat isn't acknowledged within
+	// this duration. If zero, a connection is only considered a zombie once the next heartbeat is
+	// due.
+	HeartbeatTimeout time.Duration
+
+	// HeartbeatTimeoutGrace is how long past the next heartbeat to wait for an unacknowledged
+	// heartbeat before it counts as missed
+	HeartbeatTimeoutGrace time.Duration
+
+	// MaxMissedHeartbeats is how many consecutive heartbeats may go unacknowledged before the
+	// connection is closed as a zombie. Defaults to 1.
+	MaxMissedHeartbeats int
+
+	// HeartbeatJitter returns the fraction of the heartbeat interval, in [0, 1), to wait before the
+	// first heartbeat of each connection. Defaults to Rand.
+	HeartbeatJitter func() float64
+
+	// Rand returns a random value in [0, 1) for every backoff and jitter. It must be safe for
+	// concurrent use. Defaults to a source seeded for each shard.
+	Rand func() float64
 }
 
 func (opts *ShardOptions) init() {
+	if opts.Identify != nil && len(opts.Identify.Shard) == 0 {
+		if opts.ShardCount == 0 {
+			opts.ShardCount = 1
+		}
+		opts.Identify.Shard = []int{opts.ShardID, opts.ShardCount}
+	}
+
 	if opts.Version == 0 {
 		opts.Version = DefaultVersion
 	}
 
+	if opts.Metrics == nil {
+		opts.Metrics = nopMetrics{}
+	}
+
+	if opts.Dialer == nil {
+		opts.Dialer = websocket.DefaultDialer
+	}
+
+	// copied so that a shared dialer isn't modified
+	if opts.Proxy != nil || opts.TLSConfig != nil {
+		d := *opts.Dialer
+		if opts.Proxy != nil {
+			d.Proxy = http.ProxyURL(opts.Proxy)
+		}
+		if opts.TLSConfig != nil {
+			d.TLSClientConfig = opts.TLSConfig
+		}
+		opts.Dialer = &d
+	}
+
+	if opts.Encoding == "" {
+		opts.Encoding = EncodingJSON
+	}
+
+	if opts.ShutdownCloseCode == 0 {
+		opts.ShutdownCloseCode = websocket.CloseNormalClosure
+	}
+
+	if opts.Compression == "" {
+		opts.Compression = CompressionZstdStream
+	}
+
 	if opts.Logger == nil {
 		opts.Logger = DefaultLogger
 	}
-	opts.Logger = ChildLogger(opts.Logger, fmt.Sprintf("[shard %d]", opts.Identify.Shard[0]))
+	opts.Logger = ChildLogger(opts.Logger, fmt.Sprintf("[shard %s]", opts.shardLabel()))
+
+	if opts.InitialBackoff == 0 {
+		opts.InitialBackoff = DefaultInitialBackoff
+	}
+
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+
+	if opts.BackoffFactor == 0 {
+		opts.BackoffFactor = DefaultBackoffFactor
+	}
 
 	if opts.Retryer == nil {
-		opts.Retryer = defaultRetryer{}
+		opts.Retryer = defaultRetryer{
+			initial: opts.InitialBackoff,
+			max:     opts.MaxBackoff,
+			factor:  opts.BackoffFactor,
+		}
+	}
+
+	if opts.SendLimit == 0 {
+		opts.SendLimit = DefaultSendLimit
+	}
+
+	if opts.SendInterval == 0 {
+		opts.SendInterval = DefaultSendInterval
+	}
+
+	if opts.MaxMissedHeartbeats == 0 {
+		opts.MaxMissedHeartbeats = 1
+	}
+
+	if opts.Rand == nil {
+		opts.Rand = newRand()
+	}
+
+	if opts.HeartbeatJitter == nil {
+		opts.HeartbeatJitter = opts.Rand
+	}
+
+	if opts.IdentifyInterval == 0 {
+		opts.IdentifyInterval = 5 * time.Second
 	}
 
 	if opts.IdentifyLimiter == nil {
-		opts.IdentifyLimiter = NewDefaultLimiter(1, 5*time.Second)
+		opts.IdentifyLimiter = NewDefaultLimiter(1, opts.IdentifyInterval)
+	}
+
+	if opts.Library == "" {
+		opts.Library = DefaultLibrary
+	}
+
+	// copied since headers may be shared between shards
+	if opts.RequestHeader.Get("User-Agent") == "" {
+		h := opts.RequestHeader.Clone()
+		if h == nil {
+			h = make(http.Header)
+		}
+		h.Set("User-Agent", userAgent(opts.Library))
+		opts.RequestHeader = h
 	}
 
 	if opts.Identify != nil {
-		if opts.Identify.Properties == nil {
-			opts.Identify.Properties = &types.IdentifyProperties{
-				OS:      runtime.GOOS,
-				Browser: "spectacles",
-				Device:  "spectacles",
-			}
+		if opts.Intents != 0 {
+			opts.Identify.Intents = int(opts.Intents)
 		}
+
+		// copied since identifies, and therefore properties, may be shared between shards
+		var props types.IdentifyProperties
+		if opts.Properties != nil {
+			props = *opts.Properties
+		} else if opts.Identify.Properties != nil {
+			props = *opts.Identify.Properties
+		}
+
+		if props.OS == "" {
+			props.OS = runtime.GOOS
+		}
+		if props.Browser == "" {
+			props.Browser = opts.Library
+		}
+		if props.Device == "" {
+			props.Device = opts.Library
+		}
+		opts.Identify.Properties = &props
 	}
 
 	if opts.Store == nil {
@@ -63,6 +381,67 @@ func (opts *ShardOptions) init() {
 	}
 }
 
+// shardLabel identifies the shard as "id/total" in logs. It's only the ID if the options are
+// missing an identify, which validate reports.
+func (opts *ShardOptions) shardLabel() string {
+	if opts.Identify == nil || len(opts.Identify.Shard) == 0 {
+		return strconv.Itoa(opts.ShardID)
+	}
+
+	if len(opts.Identify.Shard) > 1 {
+		return fmt.Sprintf("%d/%d", opts.Identify.Shard[0], opts.Identify.Shard[1])
+	}
+	return strconv.Itoa(opts.Identify.Shard[0])
+}
+
+// validate checks for options that would be rejected by Discord
+func (opts *ShardOptions) validate() error {
+	switch opts.Version {
+	case Version9, Version10:
+	default:
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, opts.Version)
+	}
+
+	// both are sent to Discord as is, so an unknown value gets rejected or misread
+	switch opts.Compression {
+	case CompressionZstdStream, CompressionZlibStream, CompressionNone:
+	default:
+		return fmt.Errorf("%w: unknown compression %q", ErrInvalidOptions, opts.Compression)
+	}
+
+	switch opts.Encoding {
+	case EncodingJSON, EncodingETF:
+	default:
+		return fmt.Errorf("%w: unknown encoding %q", ErrInvalidOptions, opts.Encoding)
+	}
+
+	if opts.SendLimit <= heartbeatReserve {
+		return fmt.Errorf("%w: send limit must exceed the %d sends reserved for automatic heartbeats", ErrInvalidOptions, heartbeatReserve)
+	}
+
+	if opts.Identify == nil {
+		return fmt.Errorf("%w: missing identify", ErrInvalidOptions)
+	}
+
+	if opts.Identify.Token == "" {
+		return fmt.Errorf("%w: missing token", ErrInvalidOptions)
+	}
+
+	if len(opts.Identify.Shard) != 2 {
+		return fmt.Errorf("%w: shard must be [id, total], got %v", ErrInvalidOptions, opts.Identify.Shard)
+	}
+
+	if id, total := opts.Identify.Shard[0], opts.Identify.Shard[1]; id < 0 || total < 1 || id >= total {
+		return fmt.Errorf("%w: shard ID %d is out of range for %d shards", ErrInvalidOptions, id, total)
+	}
+
+	if unknown := Intents(opts.Identify.Intents).Remove(IntentsAll); unknown != 0 {
+		return fmt.Errorf("%w: unknown intents %d", ErrInvalidOptions, unknown)
+	}
+
+	return nil
+}
+
 // clone only clones whatever's necessary
 func (opts ShardOptions) clone() *ShardOptions {
 	i := *opts.Identify
@@ -70,22 +449,44 @@ func (opts ShardOptions) clone() *ShardOptions {
 	return &opts
 }
 
-type defaultRetryer struct{}
+// Default send rate limit
+const (
+	DefaultSendLimit    = 120
+	DefaultSendInterval = time.Minute
+)
 
-const maxRetries = 5
-const maxRetry = time.Minute * 5
+// Default reconnect backoff parameters
+const (
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = time.Minute
+	DefaultBackoffFactor  = 2
+)
 
-func (defaultRetryer) FirstTimeout() time.Duration { return time.Second }
-func (defaultRetryer) NextTimeout(timeout time.Duration, retries int) (time.Duration, error) {
-	if retries > maxRetries {
-		return 0, ErrMaxRetriesExceeded
-	}
+// defaultRetryer grows the timeout exponentially without ever giving up
+type defaultRetryer struct {
+	initial time.Duration
+	max     time.Duration
+	factor  float64
+}
 
-	timeout *= 2
+func (r defaultRetryer) FirstTimeout() time.Duration { return r.initial }
+func (r defaultRetryer) NextTimeout(timeout time.Duration, retries int) (time.Duration, error) {
+	timeout = time.Duration(float64(timeout) * r.factor)
 
-	if timeout > maxRetry {
-		timeout = maxRetry
+	if timeout > r.max {
+		timeout = r.max
 	}
 
 	return timeout, nil
 }
+
+// newRand returns a concurrency-safe source of random values in [0, 1)
+func newRand() func() float64 {
+	var mu sync.Mutex
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return r.Float64()
+	}
+}
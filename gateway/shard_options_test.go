@@ -0,0 +1,54 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/spec-tacles/go/types"
+)
+
+func TestOpenValidatesIdentify(t *testing.T) {
+	tests := []struct {
+		name     string
+		identify *types.Identify
+	}{
+		{"missing identify", nil},
+		{"missing token", &types.Identify{}},
+		{"shard out of range", &types.Identify{Token: "token", Shard: []int{2, 2}}},
+		{"unknown intents", &types.Identify{Token: "token", Intents: 1 << 30}},
+	}
+
+	for _, tt := range tests {
+		s := NewShard(&ShardOptions{Identify: tt.identify, LogLevel: LogLevelSuppress})
+		if err := s.Open(context.Background()); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("%s: Open returned %v, want ErrInvalidOptions", tt.name, err)
+		}
+	}
+}
+
+func TestOpenValidatesTransport(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression Compression
+		encoding    Encoding
+	}{
+		{"unknown compression", "zlib", EncodingJSON},
+		{"unknown encoding", CompressionNone, "msgpack"},
+	}
+
+	for _, tt := range tests {
+		s := NewShard(&ShardOptions{
+			Identify:    &types.Identify{Token: "token"},
+			Compression: tt.compression,
+			Encoding:    tt.encoding,
+			LogLevel:    LogLevelSuppress,
+		})
+		if err := s.Open(context.Background()); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("%s: Open returned %v, want ErrInvalidOptions", tt.name, err)
+		}
+		if err := s.PrepareStandby(context.Background()); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("%s: PrepareStandby returned %v, want ErrInvalidOptions", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package gateway
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// ShardStats is a snapshot of a shard's runtime counters
+type ShardStats struct {
+	Latency          time.Duration
+	LastHeartbeatAck time.Time
+	ReconnectCount   uint64
+	PacketsReceived  uint64
+	PacketsSent      uint64
+	// BytesReceived totals the size of each packet received, after decompression
+	BytesReceived uint64
+	SessionID     string
+	Sequence      uint
+	State         ShardState
+}
+
+// Stats returns a snapshot of the shard's counters across every connection
+func (s *Shard) Stats(ctx context.Context) (st ShardStats, err error) {
+	if st.SessionID, err = s.SessionID(ctx); err != nil {
+		return
+	}
+	if st.Sequence, err = s.Sequence(ctx); err != nil {
+		return
+	}
+
+	if ack := atomic.LoadInt64(&s.lastAck); ack != 0 {
+		st.LastHeartbeatAck = time.Unix(0, ack)
+	}
+	st.Latency = s.Latency()
+	st.ReconnectCount = atomic.LoadUint64(&s.reconnects)
+	st.PacketsReceived = atomic.LoadUint64(&s.packetsReceived)
+	st.PacketsSent = atomic.LoadUint64(&s.packetsSent)
+	st.BytesReceived = atomic.LoadUint64(&s.bytesReceived)
+	st.State = s.State()
+	return
+}
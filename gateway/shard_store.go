@@ -17,13 +17,47 @@ type ShardStore interface {
 	SetSession(ctx context.Context, shardID uint, session string) error
 }
 
+// SessionResetStore is implemented by shard stores that can clear a session in one operation.
+// Sessions in other stores are cleared by setting an empty session and resume URL and a zero
+// sequence, so their SetSeq must accept a sequence lower than the current one.
+type SessionResetStore interface {
+	ResetSession(ctx context.Context, shardID uint) error
+}
+
+// ResumeURLStore is implemented by shard stores that also store the URL to resume a session on,
+// so that a session persisted across restarts is resumed on the gateway expecting it. The resume
+// URL is cleared along with the session.
+type ResumeURLStore interface {
+	GetResumeURL(ctx context.Context, shardID uint) (url string, err error)
+	SetResumeURL(ctx context.Context, shardID uint, url string) error
+}
+
+// resetStoredSession clears the session of the given shard, using ResetSession if the store
+// supports it
+func resetStoredSession(ctx context.Context, store ShardStore, shardID uint) error {
+	if r, ok := store.(SessionResetStore); ok {
+		return r.ResetSession(ctx, shardID)
+	}
+
+	if err := store.SetSession(ctx, shardID, ""); err != nil {
+		return err
+	}
+	if r, ok := store.(ResumeURLStore); ok {
+		if err := r.SetResumeURL(ctx, shardID, ""); err != nil {
+			return err
+		}
+	}
+	return store.SetSeq(ctx, shardID, 0)
+}
+
 // LocalShardStore stores shard information in memory
 type LocalShardStore struct {
 	seqMux     *sync.RWMutex
 	sessionMux *sync.RWMutex
 
-	seqs     map[uint]uint
-	sessions map[uint]string
+	seqs       map[uint]uint
+	sessions   map[uint]string
+	resumeURLs map[uint]string
 }
 
 // NewLocalShardStore initializes a local shard store with the necessary state
@@ -33,6 +67,7 @@ func NewLocalShardStore() *LocalShardStore {
 		sessionMux: &sync.RWMutex{},
 		seqs:       make(map[uint]uint),
 		sessions:   make(map[uint]string),
+		resumeURLs: make(map[uint]string),
 	}
 }
 
@@ -74,6 +109,37 @@ func (s *LocalShardStore) SetSession(ctx context.Context, shardID uint, session
 	return nil
 }
 
+// GetResumeURL gets the URL to resume the session of the given shard on
+func (s *LocalShardStore) GetResumeURL(ctx context.Context, shardID uint) (url string, err error) {
+	s.sessionMux.RLock()
+	defer s.sessionMux.RUnlock()
+
+	url = s.resumeURLs[shardID]
+	return
+}
+
+// SetResumeURL sets the URL to resume the session of the given shard on
+func (s *LocalShardStore) SetResumeURL(ctx context.Context, shardID uint, url string) error {
+	s.sessionMux.Lock()
+	defer s.sessionMux.Unlock()
+
+	s.resumeURLs[shardID] = url
+	return nil
+}
+
+// ResetSession clears the session identifier, sequence, and resume URL of the given shard
+func (s *LocalShardStore) ResetSession(ctx context.Context, shardID uint) error {
+	s.sessionMux.Lock()
+	delete(s.sessions, shardID)
+	delete(s.resumeURLs, shardID)
+	s.sessionMux.Unlock()
+
+	s.seqMux.Lock()
+	delete(s.seqs, shardID)
+	s.seqMux.Unlock()
+	return nil
+}
+
 var setMax = radix.NewEvalScript(`
 local current = tonumber(redis.call("GET", KEYS[1]))
 if current == nil then current = 0 end
@@ -109,6 +175,23 @@ func (s *RedisShardStore) SetSession(ctx context.Context, shardID uint, session
 	return s.Redis.Do(ctx, radix.Cmd(nil, "SET", s.shardKey(shardID)+"session", session))
 }
 
+// GetResumeURL gets the URL to resume the session of the given shard on
+func (s *RedisShardStore) GetResumeURL(ctx context.Context, shardID uint) (url string, err error) {
+	err = s.Redis.Do(ctx, radix.Cmd(&url, "GET", s.shardKey(shardID)+"resume_url"))
+	return
+}
+
+// SetResumeURL sets the URL to resume the session of the given shard on
+func (s *RedisShardStore) SetResumeURL(ctx context.Context, shardID uint, url string) error {
+	return s.Redis.Do(ctx, radix.Cmd(nil, "SET", s.shardKey(shardID)+"resume_url", url))
+}
+
+// ResetSession clears the session identifier, sequence, and resume URL of the given shard
+func (s *RedisShardStore) ResetSession(ctx context.Context, shardID uint) error {
+	key := s.shardKey(shardID)
+	return s.Redis.Do(ctx, radix.Cmd(nil, "DEL", key+"session", key+"seq", key+"resume_url"))
+}
+
 func (s *RedisShardStore) shardKey(shardID uint) string {
 	return s.Prefix + strconv.FormatUint(uint64(shardID), 10)
 }
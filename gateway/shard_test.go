@@ -0,0 +1,864 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spec-tacles/gateway/gateway/gatewaytest"
+	"github.com/spec-tacles/go/types"
+)
+
+// testTimeout bounds every wait in these tests
+const testTimeout = 5 * time.Second
+
+// newTestShard creates a shard for the fake gateway
+func newTestShard(srv *gatewaytest.Server, opts *ShardOptions) *Shard {
+	s := NewShard(testOptions(opts))
+	s.Gateway = &GatewayBot{}
+	s.Gateway.URL = srv.URL()
+	return s
+}
+
+// testOptions fills in whatever options the fake gateway requires, keeping reconnect backoffs short
+func testOptions(opts *ShardOptions) *ShardOptions {
+	if opts.Identify == nil {
+		opts.Identify = &types.Identify{Token: "token", Shard: []int{0, 1}}
+	}
+	if opts.Compression == "" {
+		opts.Compression = CompressionNone
+	}
+	opts.Encoding = EncodingJSON
+	if opts.InitialBackoff == 0 {
+		opts.InitialBackoff = time.Millisecond
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 10 * time.Millisecond
+	}
+	if opts.SendInterval == 0 {
+		opts.SendInterval = 10 * time.Millisecond
+	}
+	if opts.IdentifyInterval == 0 {
+		opts.IdentifyInterval = time.Millisecond
+	}
+	if opts.LogLevel == 0 {
+		opts.LogLevel = LogLevelSuppress
+	}
+	return opts
+}
+
+// openTestShard opens the shard until the test ends, waiting for it to become ready
+func openTestShard(t *testing.T, s *Shard) <-chan error {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// closed after the result is sent, so that cleanup doesn't wait on a result that was received
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Open(ctx)
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Error("Open didn't return after the context was cancelled")
+		}
+	})
+
+	waitFor(t, "shard to be ready", func() bool { return s.State() == ShardStateReady })
+	return done
+}
+
+// waitFor polls cond until it's true, failing the test if that takes too long
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReconnectsStopHeartbeaters(t *testing.T) {
+	const (
+		interval   = 20 * time.Millisecond
+		reconnects = 20
+	)
+
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+	srv.HeartbeatInterval = interval
+
+	var heartbeats int64
+	srv.OnPacket = func(p *types.ReceivePacket) {
+		if p.Op == types.GatewayOpHeartbeat {
+			atomic.AddInt64(&heartbeats, 1)
+		}
+	}
+
+	s := newTestShard(srv, &ShardOptions{})
+	openTestShard(t, s)
+
+	for i := 1; i <= reconnects; i++ {
+		srv.Reconnect()
+		waitFor(t, "shard to resume", func() bool {
+			return srv.Resumes() >= i && s.State() == ShardStateReady
+		})
+	}
+
+	// an orphaned heartbeater from each connection would multiply the heartbeat rate
+	atomic.StoreInt64(&heartbeats, 0)
+	time.Sleep(10 * interval)
+	if n := atomic.LoadInt64(&heartbeats); n > 20 {
+		t.Fatalf("got %d heartbeats in %s at an interval of %s", n, 10*interval, interval)
+	}
+}
+
+func TestAbnormalClosureResumes(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	s := newTestShard(srv, &ShardOptions{})
+	done := openTestShard(t, s)
+
+	srv.Drop()
+	waitFor(t, "shard to resume", func() bool {
+		return srv.Resumes() == 1 && s.State() == ShardStateReady
+	})
+
+	select {
+	case err := <-done:
+		t.Fatalf("Open returned after an abnormal closure: %v", err)
+	default:
+	}
+
+	if n := srv.Identifies(); n != 1 {
+		t.Fatalf("got %d identifies, want 1", n)
+	}
+}
+
+func TestCloseStopsOpen(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	s := newTestShard(srv, &ShardOptions{})
+	done := openTestShard(t, s)
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Open returned %v after Close, want nil", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Open didn't return after Close")
+	}
+
+	if n := srv.Identifies(); n != 1 {
+		t.Fatalf("got %d identifies, want 1", n)
+	}
+	if err := s.SendPacket(types.GatewayOpHeartbeat, nil); !errors.Is(err, ErrShardClosed) {
+		t.Fatalf("SendPacket after Close returned %v, want ErrShardClosed", err)
+	}
+}
+
+func TestInvalidateIdentifiesNewSession(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	s := newTestShard(srv, &ShardOptions{})
+	openTestShard(t, s)
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		srv.Dispatch("TEST", nil)
+	}
+	waitFor(t, "dispatches", func() bool {
+		seq, _ := s.Sequence(ctx)
+		return seq == 6
+	})
+
+	if err := s.Invalidate(); err != nil {
+		t.Fatalf("Invalidate: %v", err)
+	}
+	waitFor(t, "shard to identify", func() bool {
+		return srv.Identifies() == 2 && s.State() == ShardStateReady
+	})
+
+	if n := srv.Resumes(); n != 0 {
+		t.Fatalf("got %d resumes, want 0", n)
+	}
+	if seq, _ := s.Sequence(ctx); seq != 1 {
+		t.Fatalf("got sequence %d in the new session, want 1", seq)
+	}
+	if id, _ := s.SessionID(ctx); id != "session-2" {
+		t.Fatalf("got session %q, want session-2", id)
+	}
+}
+
+func TestInvalidateWhileConnecting(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	// the resume jitter holds the shard in the connecting state
+	s := newTestShard(srv, &ShardOptions{ResumeJitter: 100 * time.Millisecond, Rand: func() float64 { return 1 }})
+	if err := s.Restore(context.Background(), "stale", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Invalidate(); err != nil {
+		t.Fatalf("Invalidate before opening: %v", err)
+	}
+	if err := s.Restore(context.Background(), "stale", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Open(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor(t, "shard to connect", func() bool { return s.State() == ShardStateConnecting })
+	if err := s.Invalidate(); err != nil {
+		t.Fatalf("Invalidate while connecting: %v", err)
+	}
+	waitFor(t, "shard to identify", func() bool {
+		return srv.Identifies() == 1 && s.State() == ShardStateReady
+	})
+
+	if n := srv.Resumes(); n != 0 {
+		t.Fatalf("got %d resumes, want 0", n)
+	}
+}
+
+func TestSetIntents(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	intents := make(chan Intents, 2)
+	srv.OnPacket = func(p *types.ReceivePacket) {
+		if p.Op == types.GatewayOpIdentify {
+			i := new(types.Identify)
+			json.Unmarshal(p.Data, i)
+			intents <- Intents(i.Intents)
+		}
+	}
+
+	s := newTestShard(srv, &ShardOptions{Intents: IntentGuilds})
+	if err := s.SetIntents(IntentGuildMessages); err != nil {
+		t.Fatalf("SetIntents before connecting: %v", err)
+	}
+
+	openTestShard(t, s)
+	if i := <-intents; i != IntentGuildMessages {
+		t.Fatalf("identified with intents %d, want %d", i, IntentGuildMessages)
+	}
+
+	if err := s.SetIntents(IntentGuildMembers); err != nil {
+		t.Fatalf("SetIntents while connected: %v", err)
+	}
+	select {
+	case i := <-intents:
+		if i != IntentGuildMembers {
+			t.Fatalf("re-identified with intents %d, want %d", i, IntentGuildMembers)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("shard didn't re-identify after SetIntents")
+	}
+
+	if n := srv.Resumes(); n != 0 {
+		t.Fatalf("got %d resumes, want 0", n)
+	}
+}
+
+func TestCancelKeepsSessionResumable(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	store := NewLocalShardStore()
+	s := newTestShard(srv, &ShardOptions{Store: store, ShutdownCloseCode: types.CloseUnknownError})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Open(ctx) }()
+	waitFor(t, "shard to be ready", func() bool { return s.State() == ShardStateReady })
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Open returned %v, want context.Canceled", err)
+	}
+	if id, _ := store.GetSession(context.Background(), 0); id != "session-1" {
+		t.Fatalf("got session %q after cancelling, want session-1", id)
+	}
+
+	// a shard restarted with the same store resumes the session
+	s = newTestShard(srv, &ShardOptions{Store: store})
+	openTestShard(t, s)
+
+	if n := srv.Identifies(); n != 1 {
+		t.Fatalf("got %d identifies, want 1", n)
+	}
+	if n := srv.Resumes(); n != 1 {
+		t.Fatalf("got %d resumes, want 1", n)
+	}
+}
+
+func TestCancelClosesNormally(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	s := newTestShard(srv, &ShardOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Open(ctx) }()
+	waitFor(t, "shard to be ready", func() bool { return s.State() == ShardStateReady })
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Open returned %v, want context.Canceled", err)
+	}
+
+	waitFor(t, "close frame", func() bool { return len(srv.CloseCodes()) == 1 })
+	if code := srv.CloseCodes()[0]; code != websocket.CloseNormalClosure {
+		t.Fatalf("closed with %d, want %d", code, websocket.CloseNormalClosure)
+	}
+}
+
+func TestSessionHandoff(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	old := newTestShard(srv, &ShardOptions{ShutdownCloseCode: types.CloseUnknownError})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- old.Open(ctx) }()
+	waitFor(t, "old shard to be ready", func() bool { return old.State() == ShardStateReady })
+
+	srv.Dispatch("TEST", nil)
+	waitFor(t, "dispatch", func() bool {
+		seq, _ := old.Sequence(context.Background())
+		return seq == 2
+	})
+
+	cancel()
+	<-done
+
+	state, err := old.ExportState(context.Background())
+	if err != nil {
+		t.Fatalf("ExportState: %v", err)
+	}
+
+	// dispatched between the shards, so only resuming from the exported sequence receives it
+	srv.Dispatch("MISSED", nil)
+
+	missed := make(chan struct{}, 1)
+	opts := testOptions(&ShardOptions{OnPacket: func(p *types.ReceivePacket) {
+		if p.Event == "MISSED" {
+			missed <- struct{}{}
+		}
+	}})
+
+	s, err := NewShardFromState(context.Background(), opts, state)
+	if err != nil {
+		t.Fatalf("NewShardFromState: %v", err)
+	}
+	s.Gateway = old.Gateway
+	openTestShard(t, s)
+
+	if n := srv.Resumes(); n != 1 {
+		t.Fatalf("got %d resumes, want 1", n)
+	}
+	if n := srv.Identifies(); n != 1 {
+		t.Fatalf("got %d identifies, want 1", n)
+	}
+
+	select {
+	case <-missed:
+	default:
+		t.Fatal("the dispatch sent between the shards wasn't replayed")
+	}
+}
+
+func TestSequenceAdvances(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	heartbeats := make(chan uint, 10)
+	srv.OnPacket = func(p *types.ReceivePacket) {
+		if p.Op == types.GatewayOpHeartbeat {
+			var seq uint
+			json.Unmarshal(p.Data, &seq)
+			heartbeats <- seq
+		}
+	}
+
+	// no automatic heartbeats, so that the manual heartbeat is the only one
+	srv.HeartbeatInterval = time.Hour
+	s := newTestShard(srv, &ShardOptions{HeartbeatJitter: func() float64 { return 0.99 }})
+	openTestShard(t, s)
+
+	ctx := context.Background()
+	if seq, _ := s.Sequence(ctx); seq != 1 {
+		t.Fatalf("got sequence %d after READY, want 1", seq)
+	}
+
+	for want := uint(2); want <= 4; want++ {
+		srv.Dispatch("TEST", nil)
+		waitFor(t, "sequence to advance", func() bool {
+			seq, _ := s.Sequence(ctx)
+			return seq == want
+		})
+	}
+
+	if _, err := s.Heartbeat(ctx); err != nil {
+		t.Fatalf("Heartbeat: %v", err)
+	}
+	if seq := <-heartbeats; seq != 4 {
+		t.Fatalf("heartbeat sent sequence %d, want 4", seq)
+	}
+}
+
+func TestReconnectOpResumes(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+	resumeSrv := gatewaytest.NewServer()
+	defer resumeSrv.Close()
+	srv.ResumeURL = resumeSrv.URL()
+
+	s := newTestShard(srv, &ShardOptions{})
+	openTestShard(t, s)
+
+	srv.Reconnect()
+	waitFor(t, "shard to resume on the resume URL", func() bool {
+		return resumeSrv.Resumes() == 1 && s.State() == ShardStateReady
+	})
+
+	if n := srv.Identifies() + resumeSrv.Identifies(); n != 1 {
+		t.Fatalf("got %d identifies, want 1", n)
+	}
+	if n := srv.Resumes(); n != 0 {
+		t.Fatalf("got %d resumes on the gateway URL, want 0", n)
+	}
+	if id, _ := s.SessionID(context.Background()); id != "session-1" {
+		t.Fatalf("got session %q after resuming, want session-1", id)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	tokens := make(chan string, 1)
+	srv.OnPacket = func(p *types.ReceivePacket) {
+		if p.Op == types.GatewayOpIdentify {
+			i := new(types.Identify)
+			json.Unmarshal(p.Data, i)
+			tokens <- i.Token
+		}
+	}
+
+	s := newTestShard(srv, &ShardOptions{Identify: &types.Identify{Token: "secret", Shard: []int{0, 1}}})
+	openTestShard(t, s)
+
+	if token := <-tokens; token != "secret" {
+		t.Fatalf("identified with token %q, want secret", token)
+	}
+	if id, _ := s.SessionID(context.Background()); id != "session-1" {
+		t.Fatalf("got session %q, want session-1", id)
+	}
+
+	const delay = 20 * time.Millisecond
+	srv.SetAckDelay(delay)
+	rtt, err := s.Heartbeat(context.Background())
+	if err != nil {
+		t.Fatalf("Heartbeat: %v", err)
+	}
+	if rtt < delay {
+		t.Fatalf("got heartbeat RTT %s with an ACK delay of %s", rtt, delay)
+	}
+}
+
+func TestResumeReplaysMissedDispatches(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	var (
+		mu   sync.Mutex
+		seqs []types.Seq
+	)
+	received := func() []types.Seq {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]types.Seq(nil), seqs...)
+	}
+
+	// the resume jitter leaves time to dispatch while the shard is disconnected
+	s := newTestShard(srv, &ShardOptions{
+		ResumeJitter: 50 * time.Millisecond,
+		Rand:         func() float64 { return 1 },
+		OnPacket: func(p *types.ReceivePacket) {
+			if p.Event == "TEST" {
+				mu.Lock()
+				seqs = append(seqs, p.Seq)
+				mu.Unlock()
+			}
+		},
+	})
+	openTestShard(t, s)
+
+	ctx := context.Background()
+	for resumes, last := 1, types.Seq(1); resumes <= 2; resumes++ {
+		srv.Drop()
+		for i := 0; i < 3; i++ {
+			srv.Dispatch("TEST", nil)
+		}
+		waitFor(t, "shard to resume", func() bool {
+			return srv.Resumes() == resumes && s.State() == ShardStateReady
+		})
+
+		// each resume replays only the dispatches after the previous one, then RESUMED
+		got := received()
+		if len(got) != resumes*3 {
+			t.Fatalf("got dispatches %v after %d resumes", got, resumes)
+		}
+		for _, seq := range got[len(got)-3:] {
+			last++
+			if seq != last {
+				t.Fatalf("got replayed dispatches %v, want %d next", got, last)
+			}
+		}
+
+		last++
+		if seq, _ := s.Sequence(ctx); seq != uint(last) {
+			t.Fatalf("got sequence %d after resuming, want %d", seq, last)
+		}
+	}
+
+	if n := srv.Identifies(); n != 1 {
+		t.Fatalf("got %d identifies, want 1", n)
+	}
+}
+
+func TestRejectedResumeIdentifies(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	var s *Shard
+	type resumeState struct {
+		sessionID, resumeURL string
+		seq                  uint
+	}
+	states := make(chan resumeState, 2)
+
+	// the shard's resume state is captured as each identify arrives, before READY replaces it
+	srv.OnPacket = func(p *types.ReceivePacket) {
+		if p.Op == types.GatewayOpIdentify {
+			ctx := context.Background()
+			var st resumeState
+			st.sessionID, _ = s.SessionID(ctx)
+			st.seq, _ = s.Sequence(ctx)
+			st.resumeURL, _ = s.resumeURL.Load().(string)
+			states <- st
+		}
+	}
+
+	s = newTestShard(srv, &ShardOptions{Rand: func() float64 { return 0 }})
+	openTestShard(t, s)
+	<-states
+
+	srv.Dispatch("TEST", nil)
+	srv.RejectResumes(true)
+	srv.Drop()
+	waitFor(t, "shard to identify", func() bool {
+		return srv.Identifies() == 2 && s.State() == ShardStateReady
+	})
+
+	if n := srv.Resumes(); n != 1 {
+		t.Fatalf("got %d resumes, want 1", n)
+	}
+	if st := <-states; st != (resumeState{}) {
+		t.Fatalf("identified after a rejected resume with resume state %+v", st)
+	}
+	if id, _ := s.SessionID(context.Background()); id != "session-2" {
+		t.Fatalf("got session %q, want session-2", id)
+	}
+}
+
+func TestInvalidSession(t *testing.T) {
+	// resumable sessions are resumed on a new connection, while others re-identify on the same one
+	tests := []struct {
+		resumable   bool
+		connections int
+		identifies  int
+		resumes     int
+	}{
+		{resumable: true, connections: 2, identifies: 1, resumes: 1},
+		{resumable: false, connections: 1, identifies: 2, resumes: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("resumable=%t", tt.resumable), func(t *testing.T) {
+			srv := gatewaytest.NewServer()
+			defer srv.Close()
+
+			s := newTestShard(srv, &ShardOptions{Rand: func() float64 { return 0 }})
+			openTestShard(t, s)
+
+			srv.InvalidateSession(tt.resumable)
+			waitFor(t, "shard to recover", func() bool {
+				return srv.Identifies()+srv.Resumes() == tt.identifies+tt.resumes && s.State() == ShardStateReady
+			})
+
+			if n := srv.Identifies(); n != tt.identifies {
+				t.Fatalf("got %d identifies, want %d", n, tt.identifies)
+			}
+			if n := srv.Resumes(); n != tt.resumes {
+				t.Fatalf("got %d resumes, want %d", n, tt.resumes)
+			}
+			if n := srv.Connections(); n != tt.connections {
+				t.Fatalf("got %d connections, want %d", n, tt.connections)
+			}
+		})
+	}
+}
+
+func TestSessionTimeoutReidentifies(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	s := newTestShard(srv, &ShardOptions{})
+	openTestShard(t, s)
+
+	srv.CloseWithCode(types.CloseSessionTimeout, "Session timed out")
+	waitFor(t, "shard to identify", func() bool {
+		return srv.Identifies() == 2 && s.State() == ShardStateReady
+	})
+
+	if n := srv.Resumes(); n != 0 {
+		t.Fatalf("got %d resumes, want 0", n)
+	}
+}
+
+func TestZombieConnectionResumes(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+	srv.HeartbeatInterval = 20 * time.Millisecond
+
+	s := newTestShard(srv, &ShardOptions{})
+	openTestShard(t, s)
+
+	srv.DropAcks(true)
+	waitFor(t, "shard to resume", func() bool { return srv.Resumes() >= 1 })
+	srv.DropAcks(false)
+	waitFor(t, "shard to be ready", func() bool { return s.State() == ShardStateReady })
+
+	if n := srv.Identifies(); n != 1 {
+		t.Fatalf("got %d identifies, want 1", n)
+	}
+}
+
+func BenchmarkProcessPacket(b *testing.B) {
+	d := []byte(`{"op":0,"s":2,"t":"MESSAGE_CREATE","d":{"id":"1","channel_id":"2","content":"hello"}}`)
+
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("ReusePackets=%t", reuse), func(b *testing.B) {
+			s := NewShard(testOptions(&ShardOptions{ReusePackets: reuse}))
+			ctx := context.Background()
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := s.processPacket(ctx, d, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestHeartbeatsUseReservedSends(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+	srv.HeartbeatInterval = 10 * time.Millisecond
+
+	var heartbeats int64
+	srv.OnPacket = func(p *types.ReceivePacket) {
+		if p.Op == types.GatewayOpHeartbeat {
+			atomic.AddInt64(&heartbeats, 1)
+		}
+	}
+
+	// every send other than the reserved heartbeats is used up by the identify
+	s := newTestShard(srv, &ShardOptions{
+		SendLimit:       heartbeatReserve + 1,
+		SendInterval:    time.Minute,
+		HeartbeatJitter: func() float64 { return 0 },
+	})
+	openTestShard(t, s)
+
+	// automatic heartbeats still go out, but only as many as are reserved
+	waitFor(t, "automatic heartbeats", func() bool { return atomic.LoadInt64(&heartbeats) == heartbeatReserve })
+	time.Sleep(10 * srv.HeartbeatInterval)
+	if n := atomic.LoadInt64(&heartbeats); n != heartbeatReserve {
+		t.Fatalf("got %d heartbeats within the send interval, want %d", n, heartbeatReserve)
+	}
+}
+
+func TestReapplyPresenceDoesNotStallReads(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	var dispatched int64
+	// the identify, presence update and resume use up every send other than the reserved heartbeats
+	s := newTestShard(srv, &ShardOptions{
+		SendLimit:       heartbeatReserve + 3,
+		SendInterval:    time.Minute,
+		ReapplyPresence: true,
+		OnPacket: func(p *types.ReceivePacket) {
+			if p.Event == "MESSAGE_CREATE" {
+				atomic.AddInt64(&dispatched, 1)
+			}
+		},
+	})
+	openTestShard(t, s)
+
+	if err := s.UpdatePresence(&types.StatusUpdate{Status: string(types.PresenceStatusIdle)}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Reconnect()
+	waitFor(t, "shard to resume", func() bool {
+		return srv.Resumes() == 1 && s.State() == ShardStateReady
+	})
+
+	// the reapplied presence is waiting on the limiter, but packets are still read
+	srv.Dispatch("MESSAGE_CREATE", map[string]string{"id": "1"})
+	waitFor(t, "dispatch after resume", func() bool { return atomic.LoadInt64(&dispatched) == 1 })
+}
+
+func TestCallbacksReceiveShardID(t *testing.T) {
+	const shardID = 3
+
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	var mu sync.Mutex
+	called := make(map[string]int)
+	record := func(callback string, shard int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if shard != shardID {
+			t.Errorf("%s got shard %d, want %d", callback, shard, shardID)
+		}
+		called[callback]++
+	}
+
+	s := newTestShard(srv, &ShardOptions{
+		Identify:      &types.Identify{Token: "token", Shard: []int{shardID, 4}},
+		OnStateChange: func(shard int, _ ShardState) { record("OnStateChange", shard) },
+		OnHandshake:   func(shard int, _ Handshake) { record("OnHandshake", shard) },
+		OnDisconnect:  func(shard int, _ int, _ string, _ error) { record("OnDisconnect", shard) },
+		OnClose: func(shard int, _ int, _ string, action CloseAction) CloseAction {
+			record("OnClose", shard)
+			return action
+		},
+		TraceHandler: func(shard int, _ []string) { record("TraceHandler", shard) },
+		OnPacket: func(p *types.ReceivePacket) {
+			if p.Event == "PANIC" {
+				panic("handler failed")
+			}
+		},
+		OnPanic: func(shard int, _ *types.ReceivePacket, _ interface{}) { record("OnPanic", shard) },
+	})
+	openTestShard(t, s)
+
+	srv.Reconnect()
+	waitFor(t, "shard to resume", func() bool {
+		return srv.Resumes() == 1 && s.State() == ShardStateReady
+	})
+	srv.Dispatch("PANIC", nil)
+
+	callbacks := []string{"OnStateChange", "OnHandshake", "OnDisconnect", "OnClose", "TraceHandler", "OnPanic"}
+	waitFor(t, "every callback", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range callbacks {
+			if called[c] == 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestRefusedCompressionFallsBack(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	s := newTestShard(srv, &ShardOptions{Compression: CompressionZstdStream})
+	openTestShard(t, s)
+
+	if c := s.Compression(); c != CompressionNone {
+		t.Fatalf("connected using %s, want %s", c, CompressionNone)
+	}
+
+	want := []string{string(CompressionZstdStream), string(CompressionZlibStream)}
+	if got := srv.RefusedCompression(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got refused compression %v, want %v", got, want)
+	}
+}
+
+func TestHeartbeatWaitsForItsOwnACK(t *testing.T) {
+	const ackDelay = 100 * time.Millisecond
+
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+	srv.SetAckDelay(ackDelay)
+
+	// the first automatic heartbeat is sent straight away, so its ACK arrives halfway through the
+	// wait for that of the manual heartbeat
+	s := newTestShard(srv, &ShardOptions{HeartbeatJitter: func() float64 { return 0 }})
+	openTestShard(t, s)
+	time.Sleep(ackDelay / 2)
+
+	rtt, err := s.Heartbeat(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt < ackDelay {
+		t.Fatalf("got RTT %s with ACKs delayed by %s", rtt, ackDelay)
+	}
+}
+
+func TestHeartbeatSendFailureRemovesWaiter(t *testing.T) {
+	s := NewShard(testOptions(&ShardOptions{}))
+	s.closed = true
+
+	if _, err := s.Heartbeat(context.Background()); !errors.Is(err, ErrShardClosed) {
+		t.Fatalf("Heartbeat returned %v, want ErrShardClosed", err)
+	}
+
+	s.ackWaitersMu.Lock()
+	defer s.ackWaitersMu.Unlock()
+	if n := len(s.ackWaiters); n != 0 {
+		t.Fatalf("%d waiters left after a failed send", n)
+	}
+}
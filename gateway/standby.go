@@ -0,0 +1,251 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spec-tacles/go/types"
+)
+
+// standby is a connection that has received HELLO and is kept alive until a connection uses it
+type standby struct {
+	url   string
+	conn  *Connection
+	hello []byte
+
+	// promote is closed to stop keeping the connection alive, and done is closed once the keeper
+	// has stopped; err is why it stopped, or nil if the connection can be used
+	promote chan struct{}
+	done    chan struct{}
+	err     error
+}
+
+// standbyRead is a message read by the standby keeper
+type standbyRead struct {
+	op  types.GatewayOp
+	err error
+}
+
+// PrepareStandby dials a connection and waits for HELLO without identifying or resuming, keeping
+// it alive with heartbeats. The shard's next connection uses it instead of dialing, skipping the
+// reconnect backoff, if it was dialed to the URL that connection needs. Any existing standby is
+// replaced, and the standby is closed once ctx is done if it hasn't been used.
+func (s *Shard) PrepareStandby(ctx context.Context) error {
+	if err := s.opts.validate(); err != nil {
+		return err
+	}
+	if err := s.checkGateway(); err != nil {
+		return err
+	}
+
+	sessionID, err := s.opts.Store.GetSession(ctx, s.idUint())
+	if err != nil {
+		return err
+	}
+	if sessionID != "" {
+		s.loadResumeURL(ctx)
+	}
+	url := s.gatewayURL(sessionID != "")
+
+	ws, err := s.dial(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	conn := NewConnection(ws, s.newCompressor())
+	conn.SetWriteTimeout(s.opts.WriteTimeout)
+	conn.SetReadLimit(s.opts.ReadLimit)
+
+	// HELLO is the first message, so waiting for it is abandoned once ctx is done
+	read := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.terminate()
+		case <-read:
+		}
+	}()
+	d, err := conn.Read()
+	close(read)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.terminate()
+		return err
+	}
+
+	p := new(types.ReceivePacket)
+	h := new(types.Hello)
+	if err = s.opts.Encoding.Unmarshal(d, p); err == nil {
+		if p.Op != types.GatewayOpHello {
+			err = fmt.Errorf("expected op to be %d, got %d", types.GatewayOpHello, p.Op)
+		} else {
+			err = unmarshalData(p, h)
+		}
+	}
+	if err != nil {
+		conn.terminate()
+		return err
+	}
+
+	sb := &standby{
+		url:     url,
+		conn:    conn,
+		hello:   d,
+		promote: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.keepStandby(ctx, sb, time.Duration(h.HeartbeatInterval)*time.Millisecond)
+
+	s.standbyMu.Lock()
+	old := s.standby
+	s.standby = sb
+	s.standbyMu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+
+	s.log(LogLevelInfo, "Prepared standby connection to %s", url)
+	return nil
+}
+
+// hasStandby returns whether a standby connection is ready to be used
+func (s *Shard) hasStandby() bool {
+	s.standbyMu.Lock()
+	defer s.standbyMu.Unlock()
+
+	if s.standby == nil {
+		return false
+	}
+
+	select {
+	case <-s.standby.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// takeStandby returns the standby connection if it's usable for a connection to url, closing it
+// otherwise
+func (s *Shard) takeStandby(url string) *standby {
+	s.standbyMu.Lock()
+	sb := s.standby
+	s.standby = nil
+	s.standbyMu.Unlock()
+
+	if sb == nil {
+		return nil
+	}
+
+	close(sb.promote)
+	<-sb.done
+
+	if sb.err != nil {
+		s.log(LogLevelWarn, "Unable to use standby connection: %s", sb.err)
+		return nil
+	}
+
+	if sb.url != url {
+		s.log(LogLevelInfo, "Discarding standby connection to %s", sb.url)
+		sb.conn.Close()
+		sb.conn.terminate()
+		return nil
+	}
+	return sb
+}
+
+// close stops keeping the standby alive and closes its connection
+func (sb *standby) close() {
+	close(sb.promote)
+	<-sb.done
+	sb.conn.Close()
+	sb.conn.terminate()
+}
+
+// keepStandby heartbeats on a standby connection until it's promoted or fails. Messages are only
+// read while ACKs are outstanding, so once promoted, anything else sent before identifying is
+// left for the read loop.
+func (s *Shard) keepStandby(ctx context.Context, sb *standby, interval time.Duration) {
+	defer close(sb.done)
+
+	t := time.NewTimer(time.Duration(float64(interval) * s.opts.HeartbeatJitter()))
+	defer t.Stop()
+
+	reads := make(chan standbyRead, 1)
+	outstanding, reading := 0, false
+	read := func() {
+		if reading || outstanding == 0 {
+			return
+		}
+
+		reading = true
+		go func() {
+			d, err := sb.conn.Read()
+			p := new(types.ReceivePacket)
+			if err == nil {
+				err = s.opts.Encoding.Unmarshal(d, p)
+			}
+			reads <- standbyRead{p.Op, err}
+		}()
+	}
+
+	heartbeat := func() error {
+		d, err := s.opts.Encoding.Marshal(&types.SendPacket{Op: types.GatewayOpHeartbeat})
+		if err == nil {
+			_, err = sb.conn.Write(d)
+		}
+		outstanding++
+		read()
+		return err
+	}
+
+	promote := sb.promote
+	var promoted <-chan time.Time
+	for sb.err == nil {
+		select {
+		case <-t.C:
+			if outstanding > 0 {
+				sb.err = ErrHeartbeatUnacknowledged
+				break
+			}
+			sb.err = heartbeat()
+			t.Reset(interval)
+
+		case r := <-reads:
+			reading = false
+			switch {
+			case r.err != nil:
+				sb.err = r.err
+			case r.op == types.GatewayOpHeartbeatACK:
+				outstanding--
+			case r.op == types.GatewayOpHeartbeat:
+				sb.err = heartbeat()
+			default:
+				sb.err = fmt.Errorf("unexpected op %d on standby connection", r.op)
+			}
+			read()
+
+		case <-promote:
+			promote = nil
+			promoted = time.After(closeTimeout)
+
+		case <-promoted:
+			sb.err = ErrHeartbeatUnacknowledged
+
+		case <-ctx.Done():
+			sb.err = ctx.Err()
+		}
+
+		// promoted once every ACK has been read, so none are left for the read loop
+		if promote == nil && outstanding == 0 && sb.err == nil {
+			return
+		}
+	}
+
+	sb.conn.Close()
+	sb.conn.terminate()
+}
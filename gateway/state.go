@@ -0,0 +1,54 @@
+package gateway
+
+// ShardState represents the connection state of a shard
+type ShardState int32
+
+// Shard states. A shard moves from Connecting to Identifying or Resuming, then to Ready. When
+// the connection ends it moves to Reconnecting and back to Connecting, or to Closed once Open
+// returns. Identifying and Resuming can also follow Ready after an invalid session.
+const (
+	ShardStateClosed ShardState = iota
+	ShardStateConnecting
+	ShardStateIdentifying
+	ShardStateResuming
+	ShardStateReady
+	ShardStateReconnecting
+)
+
+func (st ShardState) String() string {
+	switch st {
+	case ShardStateClosed:
+		return "closed"
+	case ShardStateConnecting:
+		return "connecting"
+	case ShardStateIdentifying:
+		return "identifying"
+	case ShardStateResuming:
+		return "resuming"
+	case ShardStateReady:
+		return "ready"
+	case ShardStateReconnecting:
+		return "reconnecting"
+	default:
+		return "unknown"
+	}
+}
+
+// IsConnected returns whether the shard has an open connection to the gateway
+func (s *Shard) IsConnected() bool {
+	switch s.State() {
+	case ShardStateIdentifying, ShardStateResuming, ShardStateReady:
+		return true
+	}
+	return false
+}
+
+// IsReconnecting returns whether the shard is waiting to reconnect after a connection ended
+func (s *Shard) IsReconnecting() bool {
+	return s.State() == ShardStateReconnecting
+}
+
+// IsClosed returns whether the shard isn't open
+func (s *Shard) IsClosed() bool {
+	return s.State() == ShardStateClosed
+}
@@ -7,3 +7,59 @@ type UnknownSendPacket struct {
 	GuildID uint64            `json:"guild_id,string"`
 	Packet  *types.SendPacket `json:"packet"`
 }
+
+// GatewayBot represents a GET /gateway/bot response, including fields not yet present in
+// types.GatewayBot
+type GatewayBot struct {
+	types.GatewayBot
+	SessionStartLimit SessionStartLimit `json:"session_start_limit"`
+}
+
+// SessionStartLimit represents a GatewayBot's session start limit
+type SessionStartLimit struct {
+	types.SessionStartLimit
+	MaxConcurrency int `json:"max_concurrency"`
+}
+
+// Ready represents a READY payload, including fields not yet present in types.Ready
+type Ready struct {
+	types.Ready
+	ResumeGatewayURL string `json:"resume_gateway_url"`
+}
+
+// VoiceStateUpdate represents a voice state update packet. A nil ChannelID disconnects from voice.
+type VoiceStateUpdate struct {
+	GuildID   string  `json:"guild_id"`
+	ChannelID *string `json:"channel_id"`
+	SelfMute  bool    `json:"self_mute"`
+	SelfDeaf  bool    `json:"self_deaf"`
+}
+
+// Gateway events not yet present in the types package
+const (
+	GatewayEventGuildCreate       types.GatewayEvent = "GUILD_CREATE"
+	GatewayEventGuildDelete       types.GatewayEvent = "GUILD_DELETE"
+	GatewayEventGuildMembersChunk types.GatewayEvent = "GUILD_MEMBERS_CHUNK"
+)
+
+// RequestGuildMembers represents a request guild members packet. Either Query or UserIDs must be set;
+// an empty Query with a Limit of 0 requests all members.
+type RequestGuildMembers struct {
+	GuildID   string   `json:"guild_id"`
+	Query     *string  `json:"query,omitempty"`
+	Limit     int      `json:"limit"`
+	Presences bool     `json:"presences,omitempty"`
+	UserIDs   []string `json:"user_ids,omitempty"`
+	Nonce     string   `json:"nonce,omitempty"`
+}
+
+// GuildMembersChunk represents a guild members chunk packet
+type GuildMembersChunk struct {
+	GuildID    string                 `json:"guild_id"`
+	Members    []types.GuildMember    `json:"members"`
+	ChunkIndex int                    `json:"chunk_index"`
+	ChunkCount int                    `json:"chunk_count"`
+	NotFound   []string               `json:"not_found,omitempty"`
+	Presences  []types.PresenceUpdate `json:"presences,omitempty"`
+	Nonce      string                 `json:"nonce,omitempty"`
+}
@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"context"
+
+	"github.com/spec-tacles/go/types"
+)
+
+// dispatchWaiter is a pending SendAndWait awaiting a matching dispatch
+type dispatchWaiter struct {
+	match func(*types.ReceivePacket) bool
+	reply chan *types.ReceivePacket
+}
+
+// SendAndWait sends a packet and waits for the first dispatch for which match returns true, or
+// until the context is done. Dispatches excluded by AllowEvents or DenyEvents are matched too.
+// match is called from the read loop, so it must return promptly.
+func (s *Shard) SendAndWait(ctx context.Context, op types.GatewayOp, data interface{}, match func(*types.ReceivePacket) bool) (*types.ReceivePacket, error) {
+	// buffered so that a match after the context is done doesn't block packet handling
+	w := &dispatchWaiter{
+		match: match,
+		reply: make(chan *types.ReceivePacket, 1),
+	}
+
+	// registered before sending so that a fast response can't be missed
+	s.dispatchWaitersMu.Lock()
+	s.dispatchWaiters[w] = struct{}{}
+	s.dispatchWaitersMu.Unlock()
+
+	defer func() {
+		s.dispatchWaitersMu.Lock()
+		delete(s.dispatchWaiters, w)
+		s.dispatchWaitersMu.Unlock()
+	}()
+
+	if err := s.SendPacket(op, data); err != nil {
+		return nil, err
+	}
+
+	select {
+	case p := <-w.reply:
+		return p, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// notifyDispatchWaiters delivers the dispatch to any waiters it matches
+func (s *Shard) notifyDispatchWaiters(p *types.ReceivePacket) {
+	s.dispatchWaitersMu.Lock()
+	defer s.dispatchWaitersMu.Unlock()
+
+	for w := range s.dispatchWaiters {
+		if w.match(p) {
+			w.reply <- s.retainPacket(p)
+			delete(s.dispatchWaiters, w)
+		}
+	}
+}
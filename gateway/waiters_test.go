@@ -0,0 +1,48 @@
+package gateway
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spec-tacles/gateway/gateway/gatewaytest"
+	"github.com/spec-tacles/go/types"
+)
+
+func TestSendAndWaitMatchesFilteredDispatches(t *testing.T) {
+	srv := gatewaytest.NewServer()
+	defer srv.Close()
+
+	srv.OnPacket = func(p *types.ReceivePacket) {
+		if p.Op == types.GatewayOpRequestGuildMembers {
+			go srv.Dispatch(GatewayEventGuildMembersChunk, &GuildMembersChunk{ChunkCount: 1, Nonce: "filtered"})
+		}
+	}
+
+	var delivered int32
+	s := newTestShard(srv, &ShardOptions{
+		DenyEvents: []types.GatewayEvent{GatewayEventGuildMembersChunk},
+		OnPacket: func(p *types.ReceivePacket) {
+			if p.Event == GatewayEventGuildMembersChunk {
+				atomic.StoreInt32(&delivered, 1)
+			}
+		},
+	})
+	openTestShard(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	p, err := s.SendAndWait(ctx, types.GatewayOpRequestGuildMembers, &RequestGuildMembers{GuildID: "1", Nonce: "filtered"}, func(p *types.ReceivePacket) bool {
+		return p.Event == GatewayEventGuildMembersChunk
+	})
+	if err != nil {
+		t.Fatalf("waiting on a denied event: %v", err)
+	}
+	if p.Event != GatewayEventGuildMembersChunk {
+		t.Fatalf("got %s, want %s", p.Event, GatewayEventGuildMembersChunk)
+	}
+	if atomic.LoadInt32(&delivered) != 0 {
+		t.Fatal("denied event was delivered to OnPacket")
+	}
+}
@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"sync"
+
+	"github.com/spec-tacles/go/types"
+)
+
+// dispatchQueueSize is how many dispatches may wait for a worker before the read loop blocks
+const dispatchQueueSize = 256
+
+// dispatchPool runs callbacks for dispatches off the read loop while a shard is open
+type dispatchPool struct {
+	queue chan *types.ReceivePacket
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// startDispatchWorkers starts DispatchWorkers workers, returning a function that stops them once
+// they've handled any queued dispatches. It does nothing without DispatchWorkers.
+func (s *Shard) startDispatchWorkers() (stop func()) {
+	if s.opts.DispatchWorkers <= 0 {
+		return func() {}
+	}
+
+	pool := &dispatchPool{
+		queue: make(chan *types.ReceivePacket, dispatchQueueSize),
+		stop:  make(chan struct{}),
+	}
+	s.dispatchPool.Store(pool)
+
+	pool.wg.Add(s.opts.DispatchWorkers)
+	for i := 0; i < s.opts.DispatchWorkers; i++ {
+		go s.dispatchWorker(pool)
+	}
+
+	return func() {
+		close(pool.stop)
+		pool.wg.Wait()
+	}
+}
+
+// dispatchWorker runs callbacks for queued dispatches until the pool is stopped
+func (s *Shard) dispatchWorker(pool *dispatchPool) {
+	defer pool.wg.Done()
+
+	for {
+		select {
+		case p := <-pool.queue:
+			s.runCallbacks(p)
+			continue
+		case <-pool.stop:
+		}
+
+		// drain whatever was queued before stopping
+		for {
+			select {
+			case p := <-pool.queue:
+				s.runCallbacks(p)
+			default:
+				return
+			}
+		}
+	}
+}
+
+// enqueueDispatch hands a dispatch to the workers, returning false if there aren't any
+func (s *Shard) enqueueDispatch(p *types.ReceivePacket) bool {
+	pool, _ := s.dispatchPool.Load().(*dispatchPool)
+	if pool == nil || p.Op != types.GatewayOpDispatch {
+		return false
+	}
+
+	select {
+	case pool.queue <- s.retainPacket(p):
+	case <-pool.stop:
+	}
+	return true
+}
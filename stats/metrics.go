@@ -19,6 +19,13 @@ var (
 		Help:      "Counter of packets sent over all gateway connections.",
 	}, []string{"t", "op", "shard"})
 
+	// Disconnects is a counter of connections ended, by reason
+	Disconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "disconnects",
+		Help:      "Counter of gateway connections ended, by reason.",
+	}, []string{"reason", "shard"})
+
 	// ShardsAlive is a gauge of the number of shards alive
 	ShardsAlive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "gateway",
@@ -48,5 +55,5 @@ var (
 )
 
 func init() {
-	prometheus.MustRegister(PacketsReceived, PacketsSent, ShardsAlive, TotalShards, Ping)
+	prometheus.MustRegister(PacketsReceived, PacketsSent, Disconnects, ShardsAlive, TotalShards, Ping)
 }